@@ -0,0 +1,863 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/emersion/go-message"
+	"github.com/emersion/go-message/mail"
+	"github.com/terinjokes/mailpail/pkgs/bitbucket"
+	difflib "github.com/terinjokes/mailpail/pkgs/diff"
+	"github.com/terinjokes/mailpail/pkgs/flowed"
+)
+
+// pullRequest writes the root message of the pull request, adding the
+// header fields.
+func (c *composer) pullRequest(w io.Writer, fields map[string]string, pr bitbucket.PullRequest, d *pullRequestDiff, commits []bitbucket.Commit) error {
+	to := c.address(pr.Author.User)
+
+	diff, note := d.inline(pr, c.conf.Diff.MaxLines)
+
+	data := c.templateData(pr)
+	data.DiffNote = note
+	data.Insights = d.Insights
+	data.Diffstat = difflib.Format(d.Stats, c.conf.width())
+
+	// Bitbucket lists commits newest first, but they read best in the
+	// order they were written.
+	for i := len(commits) - 1; i >= 0; i-- {
+		data.Commits = append(data.Commits, commits[i])
+	}
+
+	subject, err := c.subject("pullRequest", data)
+	if err != nil {
+		return err
+	}
+
+	var h mail.Header
+	h.SetAddressList("From", []*mail.Address{to})
+	h.SetSubject(subject)
+	h.SetDate(FromUnixMilli(pr.CreatedDate))
+	c.addTrace(&h)
+	h.SetMsgIDList("Message-Id", []string{c.messageID(pullRequestItemKeyFunc(pr))})
+	h.Set("Content-Location", pr.Links.Self[0].Href)
+	c.addMetadata(&h, pr, "OPENED", pr.Links.Self[0].Href)
+	addFields(&h, fields)
+
+	summary, err := c.execute("pullRequest", "summary", data)
+	if err != nil {
+		return err
+	}
+
+	text, err := c.text("pullRequest", data, diff, summary)
+	if err != nil {
+		return err
+	}
+
+	var rich *bodyPart
+	if c.conf.HTML {
+		if rich, err = htmlForPullRequest(pr, diff, data); err != nil {
+			return err
+		}
+		rich = c.htmlDocument(rich, summary)
+	}
+
+	var attachments []bodyPart
+	if d.Mode == diffAttach {
+		attachments = append(attachments, bodyPart{
+			contentType: "text/x-diff",
+			params:      map[string]string{"charset": "utf-8"},
+			filename:    diffFilename(pr),
+			sevenBit:    d.check.sevenBit(),
+			write: func(w io.Writer) error {
+				_, err := io.Copy(w, d.reader(d.Files...))
+				return err
+			},
+		})
+	}
+
+	return writeBody(w, h, text, rich, attachments...)
+}
+
+// diffFile writes the message for the i-th file of a diff split into a
+// message per file.
+func (c *composer) diffFile(w io.Writer, fields map[string]string, pr bitbucket.PullRequest, d *pullRequestDiff, i int) error {
+	f := d.Files[i]
+
+	data := c.templateData(pr)
+	data.File = f.FileStat
+	data.Part = i + 1
+	data.Parts = len(d.Files)
+
+	diff := &diffText{
+		open:  func() io.Reader { return d.reader(f) },
+		check: &d.check,
+		notes: annotate(d.Insights),
+	}
+
+	rich := func() (*bodyPart, error) {
+		return htmlForDiff(diff), nil
+	}
+
+	return c.reply(w, fields, data, replyMessage{
+		kind:     "diffFile",
+		key:      pullRequestFileKeyFunc(pr, i+1),
+		author:   pr.Author.User,
+		action:   "OPENED",
+		date:     pr.CreatedDate,
+		archived: pr.Links.Self[0].Href,
+		diff:     diff,
+		rich:     rich,
+	})
+}
+
+// comment writes a message for the last comment of the thread, which starts
+// with the comment of the activity, quoting the comment it replies to and
+// with the files it links to attached.
+func (c *composer) comment(w io.Writer, fields map[string]string, pr bitbucket.PullRequest, activity bitbucket.PullRequestActivity, thread []bitbucket.PullRequestComment, attachments []attachment) error {
+	comment := withAttachments(thread[len(thread)-1], attachments)
+
+	q, err := c.quote(pr, activity, thread)
+	if err != nil {
+		return err
+	}
+
+	data := c.templateData(pr)
+	data.Activity = activity
+	data.Comment = comment
+	data.Text = c.plainText(pr, comment.Text)
+	if q != nil {
+		data.Quote = q.text()
+	}
+
+	rich := func() (*bodyPart, error) {
+		b, err := htmlForComment(comment, q)
+		if err != nil {
+			return nil, err
+		}
+
+		return htmlPart(b), nil
+	}
+
+	var parts []bodyPart
+	for _, at := range attachments {
+		parts = append(parts, at.part())
+	}
+
+	// Replies are threaded under the comments they reply to.
+	return c.reply(w, fields, data, replyMessage{
+		kind:        "comment",
+		key:         pullRequestCommentKeyFunc(pr, comment),
+		author:      comment.Author,
+		action:      activity.Action,
+		date:        comment.CreatedDate,
+		archived:    commentURL(pr, comment),
+		thread:      threadKeys(pr, thread[:len(thread)-1]),
+		rich:        rich,
+		attachments: parts,
+	})
+}
+
+// commentEdit writes a message for the n-th edit of the last comment of the
+// thread, threaded under it, showing the words changed from its old text.
+func (c *composer) commentEdit(w io.Writer, fields map[string]string, pr bitbucket.PullRequest, thread []bitbucket.PullRequestComment, old string, n int) error {
+	comment := thread[len(thread)-1]
+	changes := difflib.Words(old, comment.Text)
+
+	data := c.templateData(pr)
+	data.Comment = comment
+	data.Text = c.plainText(pr, comment.Text)
+	data.Changes = difflib.FormatWords(changes)
+
+	rich := func() (*bodyPart, error) {
+		body, err := c.execute("edited", "body", data)
+		if err != nil {
+			return nil, err
+		}
+
+		b, err := htmlForChanges(strings.TrimSuffix(body, data.Changes), changes)
+		if err != nil {
+			return nil, err
+		}
+
+		return htmlPart(b), nil
+	}
+
+	return c.reply(w, fields, data, replyMessage{
+		kind:     "edited",
+		key:      pullRequestCommentEditKeyFunc(pr, comment, n),
+		author:   comment.Author,
+		action:   "EDITED",
+		date:     comment.UpdatedDate,
+		archived: commentURL(pr, comment),
+		thread:   threadKeys(pr, thread),
+		rich:     rich,
+	})
+}
+
+// commentDeleted writes a message for the deletion of the last comment of
+// the thread at date, threaded under it, quoting its last known text.
+func (c *composer) commentDeleted(w io.Writer, fields map[string]string, pr bitbucket.PullRequest, thread []bitbucket.PullRequestComment, date int64) error {
+	comment := thread[len(thread)-1]
+
+	q, err := c.commentQuote(pr, comment, c.conf.Quote.lines())
+	if err != nil {
+		return err
+	}
+
+	data := c.templateData(pr)
+	data.Comment = comment
+	data.Text = c.plainText(pr, comment.Text)
+	if c.conf.Quote.depth() > 0 {
+		data.Quote = q.text()
+	} else {
+		q = nil
+	}
+
+	rich := func() (*bodyPart, error) {
+		body, err := c.execute("deleted", "body", data)
+		if err != nil {
+			return nil, err
+		}
+
+		b, err := htmlForText(strings.TrimPrefix(body, data.Quote), q)
+		if err != nil {
+			return nil, err
+		}
+
+		return htmlPart(b), nil
+	}
+
+	return c.reply(w, fields, data, replyMessage{
+		kind:     "deleted",
+		key:      pullRequestCommentDeletedKeyFunc(pr, comment),
+		author:   comment.Author,
+		action:   "DELETED",
+		date:     date,
+		archived: pr.Links.Self[0].Href,
+		thread:   threadKeys(pr, thread),
+		rich:     rich,
+	})
+}
+
+// description writes a message for the changes to the title and the
+// description of the pull request from the old ones.
+func (c *composer) description(w io.Writer, fields map[string]string, pr bitbucket.PullRequest, oldTitle, oldDescription string) error {
+	data := c.templateData(pr)
+	if oldTitle != pr.Title {
+		data.OldTitle = oldTitle
+	}
+	data.DescriptionDiff = difflib.Unified("a/description", "b/description", oldDescription, pr.Description, 3)
+
+	rich := func() (*bodyPart, error) {
+		body, err := c.execute("description", "body", data)
+		if err != nil {
+			return nil, err
+		}
+
+		b, err := htmlForDescription(body, data.DescriptionDiff)
+		if err != nil {
+			return nil, err
+		}
+
+		return htmlPart(b), nil
+	}
+
+	return c.reply(w, fields, data, replyMessage{
+		kind:     "description",
+		key:      pullRequestDescriptionKeyFunc(pr),
+		author:   pr.Author.User,
+		action:   "UPDATED",
+		date:     pr.UpdatedDate,
+		archived: pr.Links.Self[0].Href,
+		rich:     rich,
+	})
+}
+
+// threadKeys returns the keys of the root message and the messages of the
+// comments, for threading a message under the last of them.
+func threadKeys(pr bitbucket.PullRequest, comments []bitbucket.PullRequestComment) []string {
+	keys := []string{pullRequestItemKeyFunc(pr)}
+	for _, comment := range comments {
+		keys = append(keys, pullRequestCommentKeyFunc(pr, comment))
+	}
+
+	return keys
+}
+
+func commentURL(pr bitbucket.PullRequest, comment bitbucket.PullRequestComment) string {
+	return fmt.Sprintf("%s/overview?commentId=%d", pr.Links.Self[0].Href, comment.ID)
+}
+
+// activity writes a message for activities other than comments, such as
+// approvals and merges.
+func (c *composer) activity(w io.Writer, fields map[string]string, pr bitbucket.PullRequest, activity bitbucket.PullRequestActivity) error {
+	data := c.templateData(pr)
+	data.Activity = activity
+
+	kind := activityKinds[activity.Action]
+	rich := func() (*bodyPart, error) {
+		body, err := c.execute(kind, "body", data)
+		if err != nil {
+			return nil, err
+		}
+
+		b, err := htmlForText(body, nil)
+		if err != nil {
+			return nil, err
+		}
+
+		return htmlPart(b), nil
+	}
+
+	return c.reply(w, fields, data, replyMessage{
+		kind:     kind,
+		key:      pullRequestActivityKeyFunc(pr, activity),
+		author:   activity.User,
+		action:   activity.Action,
+		date:     activity.CreatedDate,
+		archived: pr.Links.Self[0].Href,
+		rich:     rich,
+	})
+}
+
+// replyMessage describes a message threaded under the pull request root
+// message.
+type replyMessage struct {
+	kind string
+	key  string
+	// author wrote the message about the action, taken at date in
+	// milliseconds and archived at the archived URL.
+	author   bitbucket.User
+	action   string
+	date     int64
+	archived string
+	// thread are the keys of the messages replied to, oldest first. It is
+	// the root message when empty.
+	thread []string
+	diff   *diffText
+	rich   func() (*bodyPart, error)
+	// attachments are added after the body.
+	attachments []bodyPart
+}
+
+// reply writes a message threaded under the pull request root message.
+func (c *composer) reply(w io.Writer, fields map[string]string, data TemplateData, m replyMessage) error {
+	pr := data.PullRequest
+
+	from := c.address(m.author)
+
+	subject, err := c.subject(m.kind, data)
+	if err != nil {
+		return err
+	}
+
+	thread := m.thread
+	if len(thread) == 0 {
+		thread = []string{pullRequestItemKeyFunc(pr)}
+	}
+
+	var references []string
+	for _, key := range thread {
+		references = append(references, c.messageID(key))
+	}
+
+	var h mail.Header
+	h.SetAddressList("From", []*mail.Address{from})
+	h.SetSubject(subject)
+	h.SetDate(FromUnixMilli(m.date))
+	c.addTrace(&h)
+	h.SetMsgIDList("Message-Id", []string{c.messageID(m.key)})
+	h.SetMsgIDList("In-Reply-To", references[len(references)-1:])
+	h.SetMsgIDList("References", references)
+	c.addMetadata(&h, pr, m.action, m.archived)
+	addFields(&h, fields)
+
+	summary, err := c.execute(m.kind, "summary", data)
+	if err != nil {
+		return err
+	}
+
+	text, err := c.text(m.kind, data, m.diff, summary)
+	if err != nil {
+		return err
+	}
+
+	var html *bodyPart
+	if c.conf.HTML {
+		if html, err = m.rich(); err != nil {
+			return err
+		}
+		html = c.htmlDocument(html, summary)
+	}
+
+	return writeBody(w, h, text, html, m.attachments...)
+}
+
+// addTrace records when and where the message was fetched from, as the
+// Date is when the action was taken in Bitbucket.
+func (c *composer) addTrace(h *mail.Header) {
+	fetched := time.Now().Format(time.RFC1123Z)
+	h.Set("Received", fmt.Sprintf("from %s by mailpail with HTTPS; %s", c.host, fetched))
+	h.Set("X-Mailpail-Fetched", fetched)
+}
+
+// addMetadata adds the mailing list style header fields describing the pull
+// request, for filtering messages in mail clients.
+func (c *composer) addMetadata(h *mail.Header, pr bitbucket.PullRequest, action, archived string) {
+	var (
+		proj = pr.ToRef.Repository.Project.Key
+		repo = pr.ToRef.Repository.Slug
+	)
+
+	listID := strings.ToLower(repo + "." + proj + "." + c.domain)
+	h.Set("List-Id", fmt.Sprintf("%q <%s>", proj+"/"+repo, listID))
+	h.Set("Archived-At", "<"+archived+">")
+
+	h.SetAddressList("To", []*mail.Address{c.address(pr.Author.User)})
+
+	var cc []*mail.Address
+	for _, r := range pr.Reviewers {
+		cc = append(cc, c.address(r.User))
+	}
+	if len(cc) > 0 {
+		h.SetAddressList("Cc", cc)
+	}
+
+	h.Set("X-Mailpail-Project", proj)
+	h.Set("X-Mailpail-Repository", repo)
+	// Set would canonicalize the key as X-Mailpail-Pr.
+	h.AddRaw([]byte("X-Mailpail-PR: " + strconv.Itoa(pr.ID) + "\r\n"))
+	h.Set("X-Mailpail-State", pr.State)
+	h.Set("X-Mailpail-Version", strconv.Itoa(pr.Version))
+	h.Set("X-Mailpail-Open-Tasks", strconv.Itoa(propertyCount(pr, "openTaskCount")))
+	h.Set("X-Mailpail-Action", action)
+	if role := c.role(pr); role != "" {
+		h.Set("X-Mailpail-Role", role)
+	}
+}
+
+// role returns the role of the user in the pull request: "author",
+// "reviewer" or "participant", or nothing if they are not involved.
+func (c *composer) role(pr bitbucket.PullRequest) string {
+	if c.user == "" {
+		return ""
+	}
+
+	if pr.Author.User.Slug == c.user {
+		return "author"
+	}
+
+	for _, r := range pr.Reviewers {
+		if r.User.Slug == c.user {
+			return "reviewer"
+		}
+	}
+
+	for _, p := range pr.Participants {
+		if p.User.Slug == c.user {
+			return "participant"
+		}
+	}
+
+	return ""
+}
+
+// text builds the plain text part of a message from the body template, and
+// the patch and trailer templates written before and after the diff. The
+// summary is written above the body, or as the signature after the trailer.
+func (c *composer) text(kind string, data TemplateData, diff *diffText, summary string) (bodyPart, error) {
+	var texts []string
+	for _, name := range []string{"body", "patch", "trailer"} {
+		s, err := c.execute(kind, name, data)
+		if err != nil {
+			return bodyPart{}, err
+		}
+
+		texts = append(texts, s)
+	}
+
+	var header, footer string
+	if summary != "" {
+		if c.conf.Summary == summaryHeader {
+			header = summary + "\n"
+		} else {
+			footer = "-- \n" + summary
+		}
+	}
+
+	text := newTextBody(c.conf, diff, texts[1], texts[2], header, footer)
+	if footer != "" {
+		footer = text.signature(texts...) + summary
+	}
+
+	text.fixed(header)
+	text.prose(texts[0])
+	text.fixed(texts[1])
+	if diff != nil {
+		text.diff(diff)
+	}
+	text.fixed(texts[2])
+	text.fixed(footer)
+
+	return text.part(), nil
+}
+
+// signature returns the separator starting a signature after the texts,
+// unless the last of them already ends with one. Flowed texts always end
+// their last line.
+func (t *textBody) signature(texts ...string) string {
+	var last string
+	for _, s := range texts {
+		if s != "" {
+			last = s
+		}
+	}
+
+	switch {
+	case strings.HasSuffix(last, "-- \n"):
+		return ""
+	case strings.HasSuffix(last, "\n") || t.flowed:
+		return "\n-- \n"
+	}
+
+	return "\n\n-- \n"
+}
+
+// diffText is a diff written into a message, which is read as many times as
+// it is written.
+type diffText struct {
+	open  func() io.Reader
+	check *lineCheck
+	// notes are shown after the lines they annotate.
+	notes annotations
+}
+
+// textBody builds the plain text part of a message, which is format=flowed
+// when enabled. Prose is reflowed, while fixed text such as diffs is kept
+// as is. Diffs are only read when the body is written.
+type textBody struct {
+	conf     ConfigMessage
+	flowed   bool
+	sevenBit bool
+	segments []func(io.Writer) error
+	// open is whether the text ends without a line break, which is added
+	// when flowed, so the text that follows starts on the line after it.
+	open bool
+}
+
+// newTextBody returns a textBody for the message. As fixed lines cannot end
+// in a space, the body is only flowed if the diff and all of the fixed texts
+// that will be written to it can be.
+func newTextBody(conf ConfigMessage, diff *diffText, fixed ...string) *textBody {
+	t := &textBody{conf: conf, sevenBit: true}
+	if !conf.Flowed || (diff != nil && !diff.check.fixable()) {
+		return t
+	}
+
+	for _, f := range fixed {
+		if !flowed.Fixable([]byte(f)) {
+			return t
+		}
+	}
+
+	t.flowed = true
+	return t
+}
+
+func (t *textBody) prose(s string) {
+	t.write(s, (*flowed.Writer).WriteFlowed)
+}
+
+func (t *textBody) fixed(s string) {
+	if s == "" {
+		return
+	}
+
+	t.write(s, (*flowed.Writer).WriteFixed)
+}
+
+func (t *textBody) write(s string, flow func(*flowed.Writer, string) error) {
+	b := []byte(strings.ReplaceAll(s, flowed.Fixed, ""))
+	if t.flowed {
+		// The flowed writers end every line, so the line break ending an
+		// open line was already written.
+		if t.open {
+			s = strings.TrimPrefix(s, "\n")
+		}
+		t.open = !strings.HasSuffix(s, "\n")
+		if s == "" {
+			t.open = false
+			return
+		}
+
+		var buf bytes.Buffer
+		flow(flowed.NewWriter(&buf, t.conf.width()), s)
+		b = buf.Bytes()
+	}
+
+	t.sevenBit = t.sevenBit && isSevenBit(b)
+	t.segments = append(t.segments, func(w io.Writer) error {
+		_, err := w.Write(b)
+		return err
+	})
+}
+
+// diff writes the diff as fixed lines, with the notes after the lines they
+// annotate. Blank context lines are written as empty lines when flowed, as
+// they would otherwise end in a space.
+func (t *textBody) diff(d *diffText) {
+	t.sevenBit = t.sevenBit && d.check.sevenBit() && d.notes.sevenBit()
+	t.open = false
+	t.segments = append(t.segments, func(w io.Writer) error {
+		if !t.flowed && len(d.notes) == 0 {
+			_, err := io.Copy(w, d.open())
+			return err
+		}
+
+		write := func(line string) error {
+			_, err := io.WriteString(w, line)
+			return err
+		}
+		if t.flowed {
+			fw := flowed.NewWriter(w, t.conf.width())
+			write = func(line string) error {
+				line = strings.TrimSuffix(line, "\n")
+				if line == " " {
+					line = ""
+				}
+				return fw.WriteFixed(line)
+			}
+		}
+
+		var pos difflib.Position
+
+		br := bufio.NewReader(d.open())
+		for {
+			line, err := br.ReadString('\n')
+			if err != nil && err != io.EOF {
+				return err
+			}
+			if line == "" {
+				return nil
+			}
+
+			if err := write(line); err != nil {
+				return err
+			}
+
+			var notes []string
+			if path, n := pos.Line(strings.TrimSuffix(line, "\n")); n > 0 {
+				notes = d.notes[annotatedLine{path, n}]
+			}
+			if len(notes) > 0 && !strings.HasSuffix(line, "\n") {
+				// The notes start lines of their own.
+				if err := write("\n"); err != nil {
+					return err
+				}
+			}
+			for _, note := range notes {
+				if err := write(noteLine(note) + "\n"); err != nil {
+					return err
+				}
+			}
+
+			if err == io.EOF {
+				return nil
+			}
+		}
+	})
+}
+
+// part returns the body as a text/plain part.
+func (t *textBody) part() bodyPart {
+	params := map[string]string{"charset": "utf-8"}
+	if t.flowed {
+		params["format"] = "flowed"
+	}
+
+	return bodyPart{
+		contentType: "text/plain",
+		params:      params,
+		sevenBit:    t.sevenBit,
+		write: func(w io.Writer) error {
+			for _, s := range t.segments {
+				if err := s(w); err != nil {
+					return err
+				}
+			}
+
+			return nil
+		},
+	}
+}
+
+// bodyPart is a part of a message body, written when the message is.
+type bodyPart struct {
+	contentType string
+	params      map[string]string
+	// filename is the name of an attachment, and contentID the Content-Id
+	// the body links to it by.
+	filename  string
+	contentID string
+	// sevenBit is whether the body is ASCII with short lines, and binary
+	// whether it is not text at all.
+	sevenBit bool
+	binary   bool
+	write    func(io.Writer) error
+}
+
+// htmlPart returns a text/html part for an HTML rendering.
+func htmlPart(b []byte) *bodyPart {
+	return &bodyPart{
+		contentType: "text/html",
+		params:      map[string]string{"charset": "utf-8"},
+		sevenBit:    isSevenBit(b),
+		write: func(w io.Writer) error {
+			_, err := w.Write(b)
+			return err
+		},
+	}
+}
+
+// writeBody writes the message header and body. When rich is not nil, the
+// body is a multipart/alternative of the plain text and the HTML rendering.
+// Attachments are added after the body in a multipart/mixed.
+func writeBody(w io.Writer, h mail.Header, text bodyPart, rich *bodyPart, attachments ...bodyPart) error {
+	if len(attachments) == 0 {
+		if rich == nil {
+			setTextHeader(&h.Header, text)
+			pw, err := mail.CreateSingleInlineWriter(w, h)
+			if err != nil {
+				return err
+			}
+
+			return writePart(pw, text)
+		}
+
+		iw, err := mail.CreateInlineWriter(w, h)
+		if err != nil {
+			return err
+		}
+
+		return writeAlternative(iw, text, *rich)
+	}
+
+	mw, err := mail.CreateWriter(w, h)
+	if err != nil {
+		return err
+	}
+
+	if rich == nil {
+		var ph mail.InlineHeader
+		setTextHeader(&ph.Header, text)
+
+		pw, err := mw.CreateSingleInline(ph)
+		if err != nil {
+			return err
+		}
+
+		if err := writePart(pw, text); err != nil {
+			return err
+		}
+	} else {
+		iw, err := mw.CreateInline()
+		if err != nil {
+			return err
+		}
+
+		if err := writeAlternative(iw, text, *rich); err != nil {
+			return err
+		}
+	}
+
+	for _, a := range attachments {
+		var ah mail.AttachmentHeader
+		setTextHeader(&ah.Header, a)
+		ah.SetFilename(a.filename)
+		if a.contentID != "" {
+			ah.Set("Content-Id", "<"+a.contentID+">")
+		}
+
+		pw, err := mw.CreateAttachment(ah)
+		if err != nil {
+			return err
+		}
+
+		if err := writePart(pw, a); err != nil {
+			return err
+		}
+	}
+
+	return mw.Close()
+}
+
+// writeAlternative writes the plain text and HTML parts of a
+// multipart/alternative.
+func writeAlternative(iw *mail.InlineWriter, parts ...bodyPart) error {
+	for _, part := range parts {
+		var ph mail.InlineHeader
+		setTextHeader(&ph.Header, part)
+
+		pw, err := iw.CreatePart(ph)
+		if err != nil {
+			return err
+		}
+
+		if err := writePart(pw, part); err != nil {
+			return err
+		}
+	}
+
+	return iw.Close()
+}
+
+func writePart(pw io.WriteCloser, part bodyPart) error {
+	if err := part.write(pw); err != nil {
+		return err
+	}
+
+	return pw.Close()
+}
+
+// setTextHeader declares a text body and the transfer encoding used for it.
+// Bodies that are ASCII with short lines are left as 7bit, while anything
+// else, including diffs with long lines, is quoted-printable. Attached files
+// that are not text are base64.
+func setTextHeader(h *message.Header, part bodyPart) {
+	h.SetContentType(part.contentType, part.params)
+
+	encoding := "7bit"
+	switch {
+	case part.binary:
+		encoding = "base64"
+	case !part.sevenBit:
+		encoding = "quoted-printable"
+	}
+
+	h.Set("Content-Transfer-Encoding", encoding)
+}
+
+// isSevenBit reports whether the body is ASCII with lines of at most 78
+// characters.
+func isSevenBit(body []byte) bool {
+	for _, line := range bytes.Split(body, []byte("\n")) {
+		if len(line) > 78 || bytes.IndexFunc(line, func(r rune) bool {
+			return r > unicode.MaxASCII || r == '\r'
+		}) >= 0 {
+			return false
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,183 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"bytes"
+	"flag"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/terinjokes/mailpail/pkgs/bitbucket"
+)
+
+var update = flag.Bool("update", false, "update the golden files")
+
+// testPullRequest is a pull request with names and a title outside of
+// ASCII, which must be encoded in the header.
+func testPullRequest() bitbucket.PullRequest {
+	repo := bitbucket.Repository{
+		Slug:    "frob",
+		ID:      1,
+		Project: bitbucket.Project{Key: "FOO"},
+	}
+
+	return bitbucket.PullRequest{
+		ID:          7,
+		Version:     1,
+		Title:       "Réparer le frobnicateur ✨",
+		Description: "Corrige le frobnicateur.",
+		State:       "OPEN",
+		CreatedDate: 1600000000000,
+		FromRef:     bitbucket.PullRequestReference{DisplayID: "feature", Repository: repo},
+		ToRef:       bitbucket.PullRequestReference{DisplayID: "main", Repository: repo},
+		Author: bitbucket.PullRequestParticipant{
+			User: bitbucket.User{Slug: "zoe", DisplayName: "Zoë Ångström", EmailAddress: "zoe@example.com"},
+		},
+		Reviewers: []bitbucket.PullRequestParticipant{
+			{User: bitbucket.User{Slug: "li", DisplayName: "李小龍", EmailAddress: "li@example.com"}},
+		},
+		Links: bitbucket.RelatedLinks{
+			Self: []bitbucket.Link{{Href: "https://bitbucket.example.com/projects/FOO/repos/frob/pull-requests/7"}},
+		},
+	}
+}
+
+// testComment is a comment on testPullRequest by an author whose name is
+// outside of ASCII.
+func testComment() (bitbucket.PullRequestActivity, bitbucket.PullRequestComment) {
+	comment := bitbucket.PullRequestComment{
+		ID:          101,
+		Author:      bitbucket.User{Slug: "li", DisplayName: "李小龍", EmailAddress: "li@example.com"},
+		CreatedDate: 1600000100000,
+		Text:        "Très bien.",
+	}
+
+	return bitbucket.PullRequestActivity{
+		ID:            3,
+		Action:        "COMMENTED",
+		CreatedDate:   comment.CreatedDate,
+		User:          comment.Author,
+		CommentAction: "ADDED",
+		Comment:       comment,
+	}, comment
+}
+
+func testComposer(t *testing.T) *composer {
+	t.Helper()
+
+	c, err := newComposer(Config{
+		API: ConfigAPI{Endpoint: "https://bitbucket.example.com/rest/api/1.0", User: "me"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return c
+}
+
+// header returns the header of a composed message, without the fields
+// recording when it was fetched.
+func header(msg []byte) string {
+	head := string(msg)
+	if i := strings.Index(head, "\r\n\r\n"); i >= 0 {
+		head = head[:i+2]
+	}
+
+	var (
+		b    strings.Builder
+		skip bool
+	)
+	for _, line := range strings.SplitAfter(head, "\r\n") {
+		if !strings.HasPrefix(line, " ") && !strings.HasPrefix(line, "\t") {
+			skip = strings.HasPrefix(line, "Received:") || strings.HasPrefix(line, "X-Mailpail-Fetched:")
+		}
+		if !skip {
+			b.WriteString(line)
+		}
+	}
+
+	return b.String()
+}
+
+func checkGolden(t *testing.T, name, got string) {
+	t.Helper()
+
+	path := filepath.Join("testdata", name+".golden")
+	if *update {
+		if err := ioutil.WriteFile(path, []byte(got), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	want, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got != string(want) {
+		t.Errorf("header differs from %s:\n%s", path, got)
+	}
+}
+
+func TestPullRequestHeader(t *testing.T) {
+	defer func(local *time.Location) { time.Local = local }(time.Local)
+	time.Local = time.UTC
+
+	d, err := ConfigDiff{}.spool(strings.NewReader(""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	var b bytes.Buffer
+	fields := map[string]string{"X-Team": "Équipe frob"}
+	if err := testComposer(t).pullRequest(&b, fields, testPullRequest(), d, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	checkGolden(t, "pullRequest", header(b.Bytes()))
+}
+
+func TestCommentHeader(t *testing.T) {
+	defer func(local *time.Location) { time.Local = local }(time.Local)
+	time.Local = time.UTC
+
+	activity, comment := testComment()
+
+	var b bytes.Buffer
+	if err := testComposer(t).comment(&b, nil, testPullRequest(), activity, []bitbucket.PullRequestComment{comment}, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	checkGolden(t, "comment", header(b.Bytes()))
+}
+
+func TestPullRequestPatchSeparator(t *testing.T) {
+	for _, desc := range []string{"Fixes the frobnicator.", "Fixes the frobnicator.\n"} {
+		for _, flowed := range []bool{false, true} {
+			c := testComposer(t)
+			c.conf.Flowed = flowed
+
+			text, err := c.text("pullRequest", TemplateData{Description: desc}, nil, "")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var b bytes.Buffer
+			if err := text.write(&b); err != nil {
+				t.Fatal(err)
+			}
+
+			// The patch follows the description as written, flowed or not.
+			if want := desc + "\n\n---\n\n"; !strings.HasPrefix(b.String(), want) {
+				t.Errorf("description %q, flowed %t: text = %q, want it to start with %q", desc, flowed, b.String(), want)
+			}
+		}
+	}
+}
@@ -0,0 +1,157 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/terinjokes/mailpail/pkgs/bitbucket"
+)
+
+// attachmentLink matches links to files attached to a repository in
+// Bitbucket markdown, "attachment:REPO/ID/NAME", where the slash before the
+// name may be escaped.
+var attachmentLink = regexp.MustCompile(`attachment:(\d+)/([0-9A-Za-z]+)(?:/|%2[Ff])([^\s()<>"']+)`)
+
+// attachment is a file linked from a comment, attached to the message for
+// the comment.
+type attachment struct {
+	// link is the link to the file in the comment, pointed at the part
+	// with the Content-Id instead.
+	link        string
+	name        string
+	contentType string
+	params      map[string]string
+	contentID   string
+	data        []byte
+}
+
+// commentAttachments fetches the files linked from the comment, up to the
+// configured size. Files that cannot be fetched are left linked.
+func (a *app) commentAttachments(ctx context.Context, pr bitbucket.PullRequest, comment bitbucket.PullRequestComment) []attachment {
+	max := a.conf.Message.Attachments.maxSize()
+	if max < 0 {
+		return nil
+	}
+
+	var (
+		key         = pullRequestCommentKeyFunc(pr, comment)
+		attachments []attachment
+		seen        = make(map[string]bool)
+	)
+	for _, m := range attachmentLink.FindAllStringSubmatch(comment.Text, -1) {
+		link, id := m[0], m[2]
+		if seen[link] {
+			continue
+		}
+		seen[link] = true
+
+		repo, ok := attachmentRepository(pr, m[1])
+		if !ok {
+			fmt.Printf("skipping attachment %s of %s: repository %s is not part of the pull request\n", id, key, m[1])
+			continue
+		}
+
+		data, typ, err := a.api.Attachment(ctx, repo.Project.Key, repo.Slug, id, max)
+		if err != nil {
+			fmt.Printf("error fetching attachment %s of %s: %s\n", id, key, err)
+			continue
+		}
+
+		name, err := url.PathUnescape(m[3])
+		if err != nil {
+			name = m[3]
+		}
+		name = path.Base(name)
+
+		at := attachment{
+			link:      link,
+			name:      name,
+			contentID: a.compose.messageID(key + ".attachment." + id),
+			data:      data,
+		}
+		at.contentType, at.params = attachmentType(data, typ, name)
+		attachments = append(attachments, at)
+	}
+
+	return attachments
+}
+
+// attachmentRepository returns the repository of the pull request with the
+// ID, as files can only be attached to its source or target repository.
+func attachmentRepository(pr bitbucket.PullRequest, id string) (bitbucket.Repository, bool) {
+	n, err := strconv.Atoi(id)
+	if err != nil {
+		return bitbucket.Repository{}, false
+	}
+
+	for _, repo := range []bitbucket.Repository{pr.ToRef.Repository, pr.FromRef.Repository} {
+		if repo.ID == n {
+			return repo, true
+		}
+	}
+
+	return bitbucket.Repository{}, false
+}
+
+// attachmentType returns the type of a file, sniffed from its content, or
+// else as reported by the server or guessed from its name, as Bitbucket
+// often serves attachments as application/octet-stream.
+func attachmentType(data []byte, reported, name string) (string, map[string]string) {
+	const unknown = "application/octet-stream"
+
+	for _, typ := range []string{http.DetectContentType(data), reported, mime.TypeByExtension(path.Ext(name))} {
+		t, params, err := mime.ParseMediaType(typ)
+		if err == nil && t != unknown {
+			return t, params
+		}
+	}
+
+	return unknown, nil
+}
+
+// withAttachments returns the comment with the links to the attached files
+// pointing at their parts.
+func withAttachments(comment bitbucket.PullRequestComment, attachments []attachment) bitbucket.PullRequestComment {
+	if len(attachments) == 0 {
+		return comment
+	}
+
+	for _, at := range attachments {
+		comment.Text = strings.ReplaceAll(comment.Text, at.link, "cid:"+at.contentID)
+	}
+
+	// The rendering by Bitbucket links to the server, so the text is
+	// rendered again.
+	comment.HTML = ""
+	return comment
+}
+
+// part returns the file as an attachment, linked to by its Content-Id.
+func (at attachment) part() bodyPart {
+	text := strings.HasPrefix(at.contentType, "text/")
+
+	return bodyPart{
+		contentType: at.contentType,
+		params:      at.params,
+		filename:    at.name,
+		contentID:   at.contentID,
+		binary:      !text,
+		sevenBit:    text && isSevenBit(at.data),
+		write: func(w io.Writer) error {
+			_, err := w.Write(at.data)
+			return err
+		},
+	}
+}
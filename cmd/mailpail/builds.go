@@ -0,0 +1,185 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"html/template"
+	"io"
+	"sort"
+	"strings"
+
+	"github.com/terinjokes/mailpail/pkgs/bitbucket"
+	"github.com/terinjokes/mailpail/pkgs/db"
+	"github.com/terinjokes/mailpail/pkgs/rules"
+)
+
+// trackBuilds delivers a message for each build of the latest commit of the
+// pull request that is new or whose status changed since it was last seen,
+// and records the statuses as seen. The builds of a pull request that was
+// seen before, but has no builds recorded, are only recorded, so the builds
+// of every pull request are not delivered at once on upgrading.
+func (a *app) trackBuilds(ctx context.Context, msg rules.Message, pr bitbucket.PullRequest, seen bool) error {
+	var (
+		proj   = pr.ToRef.Repository.Project.Key
+		repo   = pr.ToRef.Repository.Slug
+		commit = pr.FromRef.LatestCommit
+	)
+
+	statuses, err := a.api.BuildStatuses(ctx, commit)
+	if err != nil {
+		fmt.Printf("error fetching build statuses of %s: %s\n", pullRequestItemKeyFunc(pr), err)
+		return nil
+	}
+
+	builds, err := a.db.Builds(ctx, proj, repo, pr.ID)
+	if err != nil {
+		return err
+	}
+
+	baseline := seen && len(builds) == 0
+
+	seq := 0
+	known := make(map[string]db.Build, len(builds))
+	for _, b := range builds {
+		known[b.Key] = b
+		if b.Seq > seq {
+			seq = b.Seq
+		}
+	}
+
+	// Deliver the changes in the order they were made.
+	sort.SliceStable(statuses, func(i, j int) bool {
+		return statuses[i].DateAdded < statuses[j].DateAdded
+	})
+
+	var (
+		insights []Insight
+		fetched  bool
+	)
+	for _, status := range statuses {
+		b, ok := known[status.Key]
+		if ok && b.Commit == commit && b.State == status.State {
+			continue
+		}
+
+		record := db.Build{
+			Key:    status.Key,
+			Commit: commit,
+			State:  status.State,
+		}
+		if baseline {
+			if err := a.db.UpsertBuild(ctx, proj, repo, pr.ID, record); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if !fetched {
+			insights = a.codeInsights(ctx, pr)
+			fetched = true
+		}
+
+		// Skip the numbers of messages delivered before the database was
+		// rebuilt.
+		for {
+			seq++
+			delivered, err := a.db.HasMessage(ctx, a.compose.messageID(pullRequestBuildKeyFunc(pr, seq)))
+			if err != nil {
+				return err
+			}
+			if !delivered {
+				break
+			}
+		}
+
+		if err := a.deliverBuild(ctx, msg, pr, status, seq, insights); err != nil && !errors.Is(err, errDropped) {
+			return err
+		}
+
+		record.Seq = seq
+		if err := a.db.UpsertBuild(ctx, proj, repo, pr.ID, record); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// deliverBuild delivers the n-th message for the statuses of the builds of
+// the pull request, for the status of a build.
+func (a *app) deliverBuild(ctx context.Context, msg rules.Message, pr bitbucket.PullRequest, status bitbucket.BuildStatus, n int, insights []Insight) error {
+	msg.Action = "BUILD"
+	opts := a.articleOptions(pr, a.compose.buildAuthor(status), status.DateAdded)
+	return a.deliver(ctx, msg, a.compose.messageID(pullRequestBuildKeyFunc(pr, n)), func(w io.Writer, fields map[string]string) error {
+		return a.compose.build(w, fields, pr, status, n, insights)
+	}, opts...)
+}
+
+// build writes the n-th message for the statuses of the builds of the pull
+// request, for the status of a build, with the Code Insights reports on the
+// commit.
+func (c *composer) build(w io.Writer, fields map[string]string, pr bitbucket.PullRequest, status bitbucket.BuildStatus, n int, insights []Insight) error {
+	data := c.templateData(pr)
+	data.Build = status
+	data.Insights = insights
+
+	rich := func() (*bodyPart, error) {
+		body, err := c.execute("build", "body", data)
+		if err != nil {
+			return nil, err
+		}
+
+		b, err := htmlForBuild(body, insights)
+		if err != nil {
+			return nil, err
+		}
+
+		return htmlPart(b), nil
+	}
+
+	archived := status.URL
+	if archived == "" {
+		archived = pr.Links.Self[0].Href
+	}
+
+	return c.reply(w, fields, data, replyMessage{
+		kind:     "build",
+		key:      pullRequestBuildKeyFunc(pr, n),
+		author:   c.buildAuthor(status),
+		action:   "BUILD",
+		date:     status.DateAdded,
+		archived: archived,
+		rich:     rich,
+	})
+}
+
+// buildAuthor returns who messages for the status of a build are from: the
+// build, as no user reported it.
+func (c *composer) buildAuthor(status bitbucket.BuildStatus) bitbucket.User {
+	name := status.Name
+	if name == "" {
+		name = status.Key
+	}
+
+	return bitbucket.User{
+		DisplayName:  name,
+		EmailAddress: "noreply@" + c.host,
+	}
+}
+
+// htmlForBuild renders the status of a build, with the Code Insights reports
+// after it.
+func htmlForBuild(text string, insights []Insight) ([]byte, error) {
+	reports, err := htmlForInsights(insights)
+	if err != nil {
+		return nil, err
+	}
+
+	body := `<p style="white-space:pre-wrap">` + template.HTMLEscapeString(strings.TrimSpace(text)) + "</p>\n" + string(reports)
+	return []byte(body), nil
+}
@@ -3,22 +3,178 @@ package main
 import (
 	"fmt"
 	"io/ioutil"
+	"net/mail"
+	"net/url"
 	"os"
 	"path/filepath"
 
+	"github.com/terinjokes/mailpail/pkgs/rules"
 	"olympos.io/encoding/edn"
 )
 
 type Config struct {
-	API      ConfigAPI `edn:"api"`
-	Maildir  string    `edn:"maildir"`
-	Database string    `edn:"database"`
+	API      ConfigAPI     `edn:"api"`
+	Maildir  string        `edn:"maildir"`
+	Database string        `edn:"database"`
+	Rules    rules.Rules   `edn:"rules,omitempty"`
+	Message  ConfigMessage `edn:"message,omitempty"`
+}
+
+type ConfigMessage struct {
+	// HTML adds an HTML rendering of each message as a multipart/alternative.
+	HTML bool `edn:"html,omitempty"`
+	// Flowed writes plain text as format=flowed, wrapped at Width.
+	Flowed bool `edn:"flowed,omitempty"`
+	Width  int  `edn:"width,omitempty"`
+	// RenderMarkdown renders descriptions and comments as plain text,
+	// rather than mailing their markdown.
+	RenderMarkdown bool `edn:"renderMarkdown,omitempty"`
+	// Templates is a directory of templates replacing the built-in ones.
+	Templates string `edn:"templates,omitempty"`
+	// UpdateRoot rewrites the root message of a pull request in place when
+	// the pull request is updated.
+	UpdateRoot bool `edn:"updateRoot,omitempty"`
+	// Activities delivers messages for the activities other than comments,
+	// such as approvals and merges.
+	Activities bool `edn:"activities,omitempty"`
+	// Summary adds a summary of the review of the pull request to every
+	// message, as a "header" above the body or a "footer" in its signature.
+	Summary string `edn:"summary,omitempty"`
+	// Domain is the domain of generated Message-Ids, the host of the API
+	// endpoint by default.
+	Domain string `edn:"domain,omitempty"`
+	// Aliases are the addresses of users by slug, such as "Name
+	// <name@example.com>", used rather than those in Bitbucket.
+	Aliases     map[string]string `edn:"aliases,omitempty"`
+	Diff        ConfigDiff        `edn:"diff,omitempty"`
+	Quote       ConfigQuote       `edn:"quote,omitempty"`
+	Attachments ConfigAttachments `edn:"attachments,omitempty"`
+}
+
+// ConfigAttachments configures the attaching of files linked from comments.
+type ConfigAttachments struct {
+	// MaxSize is the size in bytes above which files are left linked, 5 MiB
+	// by default. A negative size disables attaching files.
+	MaxSize int64 `edn:"maxSize,omitempty"`
+}
+
+const defaultAttachmentSize = 5 << 20
+
+func (c ConfigAttachments) maxSize() int64 {
+	if c.MaxSize == 0 {
+		return defaultAttachmentSize
+	}
+
+	return c.MaxSize
+}
+
+// ConfigQuote configures the quoting of the comment or diff a reply
+// responds to.
+type ConfigQuote struct {
+	// Depth is the number of parent comments quoted, 1 by default. A
+	// negative depth disables quoting.
+	Depth int `edn:"depth,omitempty"`
+	// Lines is the number of lines quoted of each comment or diff, 10 by
+	// default.
+	Lines int `edn:"lines,omitempty"`
+}
+
+const (
+	defaultQuoteDepth = 1
+	defaultQuoteLines = 10
+)
+
+func (c ConfigQuote) depth() int {
+	if c.Depth == 0 {
+		return defaultQuoteDepth
+	}
+
+	return c.Depth
+}
+
+func (c ConfigQuote) lines() int {
+	if c.Lines <= 0 {
+		return defaultQuoteLines
+	}
+
+	return c.Lines
+}
+
+// ConfigDiff configures how the diff of a pull request is mailed.
+type ConfigDiff struct {
+	// MaxLines is the number of lines above which a diff is no longer
+	// inlined. Zero inlines every diff.
+	MaxLines int `edn:"maxLines,omitempty"`
+	// Mode is how diffs above MaxLines are mailed: "attach" (the default),
+	// "split" or "truncate".
+	Mode string `edn:"mode,omitempty"`
+	// Exclude are glob patterns of paths left out of the diff.
+	Exclude []string `edn:"exclude,omitempty"`
+}
+
+const defaultWidth = 72
+
+// host returns the host of the API endpoint.
+func (c ConfigAPI) host() (string, error) {
+	u, err := url.Parse(c.Endpoint)
+	if err != nil {
+		return "", err
+	}
+	if u.Hostname() == "" {
+		return "", fmt.Errorf("endpoint %q has no host", c.Endpoint)
+	}
+
+	return u.Hostname(), nil
+}
+
+// domain returns the domain of generated Message-Ids.
+func (c Config) domain() (string, error) {
+	if c.Message.Domain != "" {
+		return c.Message.Domain, nil
+	}
+
+	return c.API.host()
+}
+
+func (c Config) validate() error {
+	if err := c.Rules.Validate(); err != nil {
+		return err
+	}
+
+	return c.Message.validate()
+}
+
+func (c ConfigMessage) validate() error {
+	switch c.Summary {
+	case "", summaryHeader, summaryFooter:
+	default:
+		return fmt.Errorf("unknown summary placement %q", c.Summary)
+	}
+
+	for slug, alias := range c.Aliases {
+		if _, err := mail.ParseAddress(alias); err != nil {
+			return fmt.Errorf("alias of %s: %w", slug, err)
+		}
+	}
+
+	return c.Diff.validate()
+}
+
+func (c ConfigMessage) width() int {
+	if c.Width > 0 {
+		return c.Width
+	}
+
+	return defaultWidth
 }
 
 type ConfigAPI struct {
 	Endpoint  string `edn:"endpoint"`
 	Token     string `edn:"token,omitempty"`
 	TokenFile string `edn:"tokenFile,omitempty"`
+	// User is the slug of the user owning the token, used to flag messages
+	// written by or awaiting review from that user.
+	User string `edn:"user,omitempty"`
 }
 
 func (c Config) Token() (string, error) {
@@ -60,5 +216,9 @@ func LoadUserConfig() (Config, error) {
 		return Config{}, fmt.Errorf("unable to parse EDN: %w", err)
 	}
 
+	if err := conf.validate(); err != nil {
+		return Config{}, err
+	}
+
 	return conf, nil
 }
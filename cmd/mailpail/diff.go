@@ -0,0 +1,244 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"unicode"
+
+	"github.com/terinjokes/mailpail/pkgs/bitbucket"
+	difflib "github.com/terinjokes/mailpail/pkgs/diff"
+	"github.com/terinjokes/mailpail/pkgs/glob"
+)
+
+// How diffs above the inline limit are mailed.
+const (
+	diffInline   = "inline"
+	diffAttach   = "attach"
+	diffSplit    = "split"
+	diffTruncate = "truncate"
+)
+
+func (c ConfigDiff) validate() error {
+	switch c.Mode {
+	case "", diffAttach, diffSplit, diffTruncate:
+		return nil
+	}
+
+	return fmt.Errorf("unknown diff mode %q", c.Mode)
+}
+
+// mode returns how a diff of the given number of lines is mailed.
+func (c ConfigDiff) mode(lines int) string {
+	if c.MaxLines <= 0 || lines <= c.MaxLines {
+		return diffInline
+	}
+
+	if c.Mode == "" {
+		return diffAttach
+	}
+
+	return c.Mode
+}
+
+// pullRequestDiff is the diff of a pull request, spooled to a temporary file
+// so it can be mailed without holding it in memory.
+type pullRequestDiff struct {
+	// Stats are of every file, including excluded ones.
+	Stats []difflib.FileStat
+	// Files are the positions in the spool of the files that were not
+	// excluded.
+	Files []difflib.File
+	Lines int
+	Mode  string
+	// Insights are the Code Insights reports on the latest commit, whose
+	// annotations are shown next to the lines of the diff.
+	Insights []Insight
+
+	spool *os.File
+	check lineCheck
+}
+
+// spool copies the diff to a temporary file, leaving out excluded paths
+// when it is mailed, and decides how it is mailed. The diff must be closed
+// to remove the temporary file.
+func (c ConfigDiff) spool(r io.Reader) (*pullRequestDiff, error) {
+	f, err := ioutil.TempFile("", "mailpail-diff-")
+	if err != nil {
+		return nil, err
+	}
+
+	d := &pullRequestDiff{spool: f}
+
+	bw := bufio.NewWriter(f)
+	files, err := difflib.Copy(io.MultiWriter(bw, &d.check), r)
+	if err == nil {
+		err = bw.Flush()
+	}
+	if err != nil {
+		d.Close()
+		return nil, err
+	}
+	d.check.flush()
+
+	for _, f := range files {
+		d.Stats = append(d.Stats, f.FileStat)
+		if glob.MatchAnyPath(c.Exclude, f.Path) || (f.OldPath != "" && glob.MatchAnyPath(c.Exclude, f.OldPath)) {
+			continue
+		}
+
+		d.Files = append(d.Files, f)
+		d.Lines += f.Lines
+	}
+
+	d.Mode = c.mode(d.Lines)
+	return d, nil
+}
+
+// Close removes the spooled diff.
+func (d *pullRequestDiff) Close() error {
+	err := d.spool.Close()
+	if rerr := os.Remove(d.spool.Name()); err == nil {
+		err = rerr
+	}
+
+	return err
+}
+
+// reader returns a reader of the diffs of the files.
+func (d *pullRequestDiff) reader(files ...difflib.File) io.Reader {
+	readers := make([]io.Reader, 0, len(files))
+	for _, f := range files {
+		readers = append(readers, io.NewSectionReader(d.spool, f.Offset, f.Length))
+	}
+
+	return io.MultiReader(readers...)
+}
+
+// inline returns the part of the diff written into the root message, and a
+// note describing what was left out.
+func (d *pullRequestDiff) inline(pr bitbucket.PullRequest, maxLines int) (*diffText, string) {
+	diff := &diffText{
+		open:  func() io.Reader { return d.reader(d.Files...) },
+		check: &d.check,
+		notes: annotate(d.Insights),
+	}
+
+	switch d.Mode {
+	case diffAttach:
+		return nil, fmt.Sprintf("The diff is attached as %s.", diffFilename(pr))
+	case diffSplit:
+		return nil, fmt.Sprintf("The diff follows in %d messages.", len(d.Files))
+	case diffTruncate:
+		diff.open = func() io.Reader {
+			return &headLines{r: d.reader(d.Files...), n: maxLines}
+		}
+		return diff, fmt.Sprintf("[%d more lines, see %s]", d.Lines-maxLines, pr.Links.Self[0].Href)
+	}
+
+	return diff, ""
+}
+
+// diffFilename returns the filename of an attached diff.
+func diffFilename(pr bitbucket.PullRequest) string {
+	return fmt.Sprintf("%s-%s-%d.diff", pr.ToRef.Repository.Project.Key, pr.ToRef.Repository.Slug, pr.ID)
+}
+
+// headLines reads the first n lines from r.
+type headLines struct {
+	r io.Reader
+	n int
+}
+
+func (h *headLines) Read(p []byte) (int, error) {
+	if h.n <= 0 {
+		return 0, io.EOF
+	}
+
+	n, err := h.r.Read(p)
+	for i := 0; i < n; i++ {
+		if p[i] == '\n' {
+			h.n--
+			if h.n == 0 {
+				return i + 1, nil
+			}
+		}
+	}
+
+	return n, err
+}
+
+// lineCheck records whether every line written to it can be mailed as 7bit
+// and as fixed lines of flowed text.
+type lineCheck struct {
+	length   int
+	trailing bool
+	line     []byte
+
+	long, binary, unfixable bool
+}
+
+// maxLineLength is the longest line sent as 7bit, less one for the space
+// flowed text may stuff at the start of a line.
+const maxLineLength = 77
+
+func (c *lineCheck) Write(p []byte) (int, error) {
+	for _, b := range p {
+		if b == '\n' {
+			c.endLine()
+			continue
+		}
+
+		c.length++
+		if c.length > maxLineLength {
+			c.long = true
+		}
+		if b > unicode.MaxASCII || b == '\r' {
+			c.binary = true
+		}
+		c.trailing = b == ' '
+		if len(c.line) < len(flowedSignature) {
+			c.line = append(c.line, b)
+		}
+	}
+
+	return len(p), nil
+}
+
+// flowedSignature is the only fixed line of flowed text that may end in a
+// space. Blank context lines, a single space, are written as empty lines.
+const flowedSignature = "-- "
+
+func (c *lineCheck) endLine() {
+	if c.trailing && c.length > 1 && !(c.length == len(flowedSignature) && string(c.line) == flowedSignature) {
+		c.unfixable = true
+	}
+
+	c.length = 0
+	c.trailing = false
+	c.line = c.line[:0]
+}
+
+// sevenBit reports whether the diff can be mailed as 7bit.
+func (c *lineCheck) sevenBit() bool {
+	return !c.long && !c.binary
+}
+
+// flush checks the last line, if it did not end in a newline.
+func (c *lineCheck) flush() {
+	if c.length > 0 {
+		c.endLine()
+	}
+}
+
+// fixable reports whether the diff can be written as fixed lines of flowed
+// text, once blank context lines are emptied.
+func (c *lineCheck) fixable() bool {
+	return !c.unfixable
+}
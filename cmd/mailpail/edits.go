@@ -0,0 +1,211 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/terinjokes/mailpail/pkgs/bitbucket"
+	"github.com/terinjokes/mailpail/pkgs/db"
+	"github.com/terinjokes/mailpail/pkgs/rules"
+)
+
+// trackComments delivers messages for the comments edited or deleted, and
+// the tasks resolved or reopened, since they were last seen, and records
+// the comments of the activities as seen. Comments seen for the first time
+// are only recorded. The activities must be complete, as recorded comments
+// missing from them are taken as deleted.
+func (a *app) trackComments(ctx context.Context, msg rules.Message, pr bitbucket.PullRequest, activities []bitbucket.PullRequestActivity) error {
+	var (
+		proj = pr.ToRef.Repository.Project.Key
+		repo = pr.ToRef.Repository.Slug
+	)
+
+	records, err := a.db.Comments(ctx, proj, repo, pr.ID)
+	if err != nil {
+		return err
+	}
+
+	known := make(map[int]db.Comment, len(records))
+	for _, r := range records {
+		known[r.ID] = r
+	}
+
+	seen := make(map[int]bool)
+	var track func(thread []bitbucket.PullRequestComment) error
+	track = func(thread []bitbucket.PullRequestComment) error {
+		comment := thread[len(thread)-1]
+		seen[comment.ID] = true
+
+		r, err := commentRecord(thread)
+		if err != nil {
+			return err
+		}
+
+		prev, ok := known[comment.ID]
+		if ok {
+			r.Edits = prev.Edits
+			r.Tasks = prev.Tasks
+		}
+
+		changed := ok && !bytes.Equal(prev.Data, r.Data)
+		if changed {
+			var old bitbucket.PullRequestComment
+			if err := json.Unmarshal(prev.Data, &old); err != nil {
+				return fmt.Errorf("decoding comment %d: %w", prev.ID, err)
+			}
+
+			if prev.Hash != r.Hash {
+				r.Edits++
+				if err := a.deliverCommentEdit(ctx, msg, pr, thread, old.Text, r.Edits); err != nil && !errors.Is(err, errDropped) {
+					return err
+				}
+			}
+
+			for _, change := range taskChanges(old, comment) {
+				r.Tasks++
+				if err := a.deliverTask(ctx, msg, pr, thread, change, r.Tasks); err != nil && !errors.Is(err, errDropped) {
+					return err
+				}
+			}
+		}
+
+		// Other changes bump the version and are only recorded.
+		if !ok || changed || prev.Version != r.Version || prev.Parent != r.Parent || prev.Deleted {
+			if err := a.db.UpsertComment(ctx, proj, repo, pr.ID, r); err != nil {
+				return err
+			}
+			known[comment.ID] = r
+		}
+
+		for _, reply := range comment.Comments {
+			if err := track(append(thread[:len(thread):len(thread)], reply)); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	}
+
+	for _, activity := range activities {
+		if activity.Action != "COMMENTED" || activity.CommentAction == "DELETED" {
+			continue
+		}
+
+		if err := track([]bitbucket.PullRequestComment{activity.Comment}); err != nil {
+			return err
+		}
+	}
+
+	for _, r := range records {
+		if seen[r.ID] || r.Deleted {
+			continue
+		}
+
+		thread, err := recordedThread(known, r.ID)
+		if err != nil {
+			return err
+		}
+
+		if err := a.deliverCommentDeleted(ctx, msg, pr, thread, deletedDate(activities, r.ID)); err != nil && !errors.Is(err, errDropped) {
+			return err
+		}
+
+		r.Deleted = true
+		if err := a.db.UpsertComment(ctx, proj, repo, pr.ID, r); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// commentRecord records the last comment of the thread as seen.
+func commentRecord(thread []bitbucket.PullRequestComment) (db.Comment, error) {
+	comment := thread[len(thread)-1]
+	sum := sha256.Sum256([]byte(comment.Text))
+
+	r := db.Comment{
+		ID:      comment.ID,
+		Version: comment.Version,
+		Hash:    hex.EncodeToString(sum[:]),
+	}
+	if len(thread) > 1 {
+		r.Parent = thread[len(thread)-2].ID
+	}
+
+	// Replies are recorded on their own.
+	comment.Comments = nil
+
+	var err error
+	r.Data, err = json.Marshal(comment)
+	return r, err
+}
+
+// recordedThread rebuilds the thread of a recorded comment from the comments
+// it replies to.
+func recordedThread(known map[int]db.Comment, id int) ([]bitbucket.PullRequestComment, error) {
+	var thread []bitbucket.PullRequestComment
+	for id != 0 {
+		r, ok := known[id]
+		if !ok {
+			return nil, fmt.Errorf("comment %d was not recorded", id)
+		}
+
+		var comment bitbucket.PullRequestComment
+		if err := json.Unmarshal(r.Data, &comment); err != nil {
+			return nil, fmt.Errorf("decoding comment %d: %w", id, err)
+		}
+
+		thread = append([]bitbucket.PullRequestComment{comment}, thread...)
+		id = r.Parent
+	}
+
+	return thread, nil
+}
+
+// deletedDate returns when the comment was deleted, from its deletion
+// activity if there is one, or else now.
+func deletedDate(activities []bitbucket.PullRequestActivity, id int) int64 {
+	for _, activity := range activities {
+		if activity.Action == "COMMENTED" && activity.CommentAction == "DELETED" && activity.Comment.ID == id {
+			return activity.CreatedDate
+		}
+	}
+
+	return time.Now().UnixNano() / int64(time.Millisecond)
+}
+
+// deliverCommentEdit delivers a message for the n-th edit of the last
+// comment of the thread.
+func (a *app) deliverCommentEdit(ctx context.Context, msg rules.Message, pr bitbucket.PullRequest, thread []bitbucket.PullRequestComment, old string, n int) error {
+	comment := thread[len(thread)-1]
+
+	msg.Action = "EDITED"
+	opts := a.articleOptions(pr, comment.Author, comment.UpdatedDate)
+	return a.deliver(ctx, msg, a.compose.messageID(pullRequestCommentEditKeyFunc(pr, comment, n)), func(w io.Writer, fields map[string]string) error {
+		return a.compose.commentEdit(w, fields, pr, thread, old, n)
+	}, opts...)
+}
+
+// deliverCommentDeleted delivers a message for the deletion of the last
+// comment of the thread.
+func (a *app) deliverCommentDeleted(ctx context.Context, msg rules.Message, pr bitbucket.PullRequest, thread []bitbucket.PullRequestComment, date int64) error {
+	comment := thread[len(thread)-1]
+
+	msg.Action = "DELETED"
+	opts := a.articleOptions(pr, comment.Author, date)
+	return a.deliver(ctx, msg, a.compose.messageID(pullRequestCommentDeletedKeyFunc(pr, comment)), func(w io.Writer, fields map[string]string) error {
+		return a.compose.commentDeleted(w, fields, pr, thread, date)
+	}, opts...)
+}
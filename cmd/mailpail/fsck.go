@@ -0,0 +1,303 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/terinjokes/mailpail/pkgs/maildir"
+)
+
+// fsck cross-checks the delivery database against the messages in the
+// Maildir, optionally repairing the differences.
+func (a *app) fsck(ctx context.Context, args []string) error {
+	flags := flag.NewFlagSet("fsck", flag.ExitOnError)
+	redeliver := flags.Bool("redeliver", false, "redeliver messages missing from the Maildir")
+	prune := flags.Bool("prune", false, "remove duplicate messages from the Maildir")
+	flags.Parse(args)
+
+	var (
+		found = make(map[string][]string)
+		keys  = make(map[string]messageKey)
+	)
+
+	err := a.walkMessages(func(folder, path, id string, key messageKey) error {
+		found[id] = append(found[id], path)
+		keys[id] = key
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	records, err := a.db.Messages(ctx)
+	if err != nil {
+		return err
+	}
+
+	var (
+		recorded = make(map[string]string)
+		dropped  = make(map[string]bool)
+	)
+	for _, r := range records {
+		recorded[r.MessageID] = r.Filename
+		dropped[r.MessageID] = r.Dropped
+		if k, ok := parseMessageID(r.MessageID); ok {
+			keys[r.MessageID] = k
+		}
+	}
+
+	pulls, err := a.db.PullRequests(ctx)
+	if err != nil {
+		return err
+	}
+
+	// Pull requests delivered before messages were recorded are only known
+	// by their state, so check their root messages too. Those dropped by a
+	// rule before drops were recorded are found to be dropped when
+	// redelivered.
+	for _, p := range pulls {
+		key := messageKey{Project: p.Project, Repo: p.Repo, ID: p.ID}
+		id := a.compose.messageID(key.String())
+		if _, ok := recorded[id]; !ok {
+			recorded[id] = ""
+			keys[id] = key
+		}
+	}
+
+	var missing, orphaned, duplicates []string
+	for id := range recorded {
+		if len(found[id]) == 0 && !dropped[id] {
+			missing = append(missing, id)
+		}
+	}
+	for id, paths := range found {
+		if _, ok := recorded[id]; !ok {
+			orphaned = append(orphaned, id)
+		}
+		if len(paths) > 1 {
+			duplicates = append(duplicates, id)
+		}
+	}
+	sort.Strings(missing)
+	sort.Strings(orphaned)
+	sort.Strings(duplicates)
+
+	problems := 0
+	for _, id := range missing {
+		fmt.Printf("missing: <%s>\n", id)
+		if !*redeliver {
+			problems++
+			continue
+		}
+
+		switch err := a.redeliver(ctx, keys[id]); {
+		case errors.Is(err, errDropped):
+			fmt.Printf("  dropped by a rule\n")
+		case err != nil:
+			fmt.Printf("  unable to redeliver: %s\n", err)
+			problems++
+		default:
+			fmt.Printf("  redelivered\n")
+		}
+	}
+
+	for _, id := range orphaned {
+		fmt.Printf("orphaned: <%s> (run mailpail reindex to adopt)\n", id)
+		problems++
+	}
+
+	for _, id := range duplicates {
+		fmt.Printf("duplicate: <%s>\n", id)
+		paths := found[id]
+
+		// Keep the copy the database knows about, or else the first one.
+		keep := paths[0]
+		var named []string
+		for _, path := range paths {
+			if maildir.UniqueName(path) == recorded[id] {
+				keep = path
+				named = append(named, path)
+			}
+		}
+
+		// Copies sharing the recorded name are left when a mail client
+		// renames a root message while it is rewritten. The copy fetched
+		// last holds the rewritten text, and is moved over another, whose
+		// name holds the flags set by the client.
+		if len(named) > 1 {
+			latest := latestFetched(named)
+			for _, path := range named {
+				if path != latest {
+					keep = path
+					break
+				}
+			}
+
+			if !*prune {
+				fmt.Printf("  rewritten %s\n", latest)
+			} else {
+				if err := os.Rename(latest, keep); err != nil {
+					return err
+				}
+				fmt.Printf("  moved %s to %s\n", latest, keep)
+			}
+
+			var rest []string
+			for _, path := range paths {
+				if path != latest {
+					rest = append(rest, path)
+				}
+			}
+			paths = rest
+		}
+
+		for _, path := range paths {
+			if path == keep {
+				fmt.Printf("  keep %s\n", path)
+				continue
+			}
+
+			if !*prune {
+				fmt.Printf("  duplicate %s\n", path)
+				continue
+			}
+
+			if err := os.Remove(path); err != nil {
+				return err
+			}
+			fmt.Printf("  removed %s\n", path)
+		}
+
+		if !*prune {
+			problems++
+		}
+	}
+
+	folders, err := a.md.Folders()
+	if err != nil {
+		return err
+	}
+
+	for _, md := range append([]maildir.Maildir{a.md}, folders...) {
+		stale, err := md.StaleTmp(tmpMaxAge)
+		if err != nil {
+			return err
+		}
+
+		for _, path := range stale {
+			fmt.Printf("stale: %s (removed by the next sync)\n", path)
+			problems++
+		}
+	}
+
+	if problems > 0 {
+		return fmt.Errorf("%d problems found", problems)
+	}
+
+	return nil
+}
+
+// latestFetched returns the path of the message fetched last, by its
+// X-Mailpail-Fetched header.
+func latestFetched(paths []string) string {
+	var (
+		latest  string
+		fetched time.Time
+	)
+	for _, path := range paths {
+		h, err := readHeader(path)
+		if err != nil {
+			continue
+		}
+
+		t, err := time.Parse(time.RFC1123Z, h.Get("X-Mailpail-Fetched"))
+		if latest == "" || (err == nil && t.After(fetched)) {
+			latest, fetched = path, t
+		}
+	}
+
+	if latest == "" {
+		return paths[0]
+	}
+
+	return latest
+}
+
+// redeliver fetches and delivers a message again.
+func (a *app) redeliver(ctx context.Context, key messageKey) error {
+	if key.Edit != 0 || key.Deleted || key.Task != 0 {
+		// Only the latest text and state of a comment is kept.
+		return fmt.Errorf("edits, deletions and tasks of comments cannot be redelivered")
+	}
+
+	if key.Description != 0 {
+		return fmt.Errorf("changes to the description cannot be redelivered")
+	}
+
+	if key.Build != 0 {
+		// Only the latest status of a build is kept.
+		return fmt.Errorf("build statuses cannot be redelivered")
+	}
+
+	pr, err := a.api.PullRequest(ctx, key.Project, key.Repo, key.ID)
+	if err != nil {
+		return err
+	}
+
+	msg, err := a.ruleMessage(ctx, pr)
+	if err != nil {
+		return err
+	}
+
+	a.fetchMergeStatus(ctx, pr)
+
+	if key.Comment == 0 && key.Activity == 0 {
+		// Only the missing message is delivered, as the other parts of a
+		// split diff may still be there.
+		d, err := a.pullRequestDiff(ctx, pr)
+		if err != nil {
+			return err
+		}
+		defer d.Close()
+
+		if key.File == 0 {
+			return a.deliverRoot(ctx, msg, pr, d)
+		}
+
+		if d.Mode != diffSplit || key.File > len(d.Files) {
+			return fmt.Errorf("diff is no longer split into file %d", key.File)
+		}
+
+		return a.deliverDiffFile(ctx, msg, pr, d, key.File-1)
+	}
+
+	activities, err := a.api.PullRequestActivities(ctx, key.Project, key.Repo, key.ID)
+	if err != nil {
+		return err
+	}
+
+	for _, activity := range activities {
+		if key.Activity != 0 && activity.ID == key.Activity {
+			return a.deliverActivity(ctx, msg, pr, activity)
+		}
+	}
+
+	if key.Activity != 0 {
+		return fmt.Errorf("activity %d no longer exists", key.Activity)
+	}
+
+	if activity, thread, ok := findComment(activities, key.Comment); ok {
+		return a.deliverComment(ctx, msg, pr, activity, thread)
+	}
+
+	return fmt.Errorf("comment %d no longer exists", key.Comment)
+}
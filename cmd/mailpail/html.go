@@ -0,0 +1,323 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"html/template"
+	"io"
+	"strings"
+
+	"github.com/terinjokes/mailpail/pkgs/bitbucket"
+	difflib "github.com/terinjokes/mailpail/pkgs/diff"
+	"github.com/terinjokes/mailpail/pkgs/flowed"
+	"github.com/terinjokes/mailpail/pkgs/plaintext"
+	"github.com/yuin/goldmark"
+	"github.com/yuin/goldmark/extension"
+)
+
+var markdown = goldmark.New(goldmark.WithExtensions(extension.GFM))
+
+// pullRequestHTML is written before the diff of the pull request.
+var pullRequestHTML = template.Must(template.New("pullRequest").Parse(`{{.Description}}
+<p><a href="{{.Link}}">View pull request</a></p>
+<hr>
+{{with .DiffNote}}<p>{{.}}</p>
+{{end}}{{with .Commits}}<ul>
+{{range .}}<li><code>{{.DisplayID}}</code> {{.Subject}} ({{or .Author.DisplayName .Author.Name}})</li>
+{{end}}</ul>
+{{end}}{{with .Diffstat}}<pre style="font-family:monospace">{{.}}</pre>
+{{end}}{{.Insights}}`))
+
+const (
+	htmlHeader = "<!DOCTYPE html>\n<html>\n<body>\n"
+	htmlFooter = "\n</body>\n</html>\n"
+)
+
+// htmlDocument wraps the rendering of the body of a message in an HTML
+// document, with the summary above or below it.
+func (c *composer) htmlDocument(body *bodyPart, summary string) *bodyPart {
+	head, foot := c.summaryHTML(summary)
+
+	doc := *body
+	doc.sevenBit = body.sevenBit && isSevenBit([]byte(head+foot))
+	doc.write = func(w io.Writer) error {
+		if _, err := io.WriteString(w, htmlHeader+head); err != nil {
+			return err
+		}
+
+		if err := body.write(w); err != nil {
+			return err
+		}
+
+		_, err := io.WriteString(w, foot+htmlFooter)
+		return err
+	}
+
+	return &doc
+}
+
+// plainText renders Bitbucket markdown as plain text when enabled, with
+// mentions of users replaced by their names, looking up those not taking
+// part in the pull request. Prose is left unwrapped for flowed text, which
+// wraps it itself, while code blocks and tables are marked as fixed.
+func (c *composer) plainText(pr bitbucket.PullRequest, src string) string {
+	if !c.conf.RenderMarkdown {
+		return src
+	}
+
+	width, fixed := c.conf.width(), ""
+	if c.conf.Flowed {
+		width, fixed = 0, flowed.Fixed
+	}
+
+	names := make(map[string]string)
+	for _, participants := range [][]bitbucket.PullRequestParticipant{{pr.Author}, pr.Reviewers, pr.Participants} {
+		for _, p := range participants {
+			names[p.User.Slug] = p.User.DisplayName
+		}
+	}
+
+	text := plaintext.Render(src, plaintext.Options{
+		Width: width,
+		Mention: func(slug string) string {
+			return c.mentionName(names, slug)
+		},
+		Fixed: fixed,
+	})
+
+	// Keep the final newline, so the text is laid out as the source would.
+	if strings.HasSuffix(src, "\n") {
+		text += "\n"
+	}
+	return text
+}
+
+// renderMarkdown renders Bitbucket markdown as HTML. Raw HTML in the source
+// is omitted.
+func renderMarkdown(src string) (template.HTML, error) {
+	var b bytes.Buffer
+	if err := markdown.Convert([]byte(src), &b); err != nil {
+		return "", err
+	}
+
+	return template.HTML(b.String()), nil
+}
+
+// diffStyles colors lines of a unified diff by their prefix.
+var diffStyles = []struct {
+	prefix string
+	style  string
+}{
+	{"+++", "font-weight:bold"},
+	{"---", "font-weight:bold"},
+	{"diff ", "font-weight:bold"},
+	{"@@", "color:#6f42c1"},
+	{"+", "color:#22863a;background-color:#f0fff4"},
+	{"-", "color:#b31d28;background-color:#ffeef0"},
+}
+
+// renderDiff renders a unified diff as preformatted HTML with colored
+// additions and removals, and the notes after the lines they annotate.
+func renderDiff(w io.Writer, r io.Reader, notes annotations) error {
+	bw := bufio.NewWriter(w)
+	bw.WriteString(`<pre style="font-family:monospace">`)
+
+	var pos difflib.Position
+
+	br := bufio.NewReader(r)
+	for {
+		line, err := br.ReadString('\n')
+		if err != nil && err != io.EOF {
+			return err
+		}
+		if line == "" {
+			break
+		}
+		line = strings.TrimSuffix(line, "\n")
+
+		style := ""
+		for _, ds := range diffStyles {
+			if strings.HasPrefix(line, ds.prefix) {
+				style = ds.style
+				break
+			}
+		}
+
+		if style != "" {
+			bw.WriteString(`<span style="` + style + `">`)
+		}
+		template.HTMLEscape(bw, []byte(line))
+		if style != "" {
+			bw.WriteString(`</span>`)
+		}
+		bw.WriteString("\n")
+
+		if path, n := pos.Line(line); n > 0 {
+			for _, note := range notes[annotatedLine{path, n}] {
+				bw.WriteString(`<span style="color:#735c0f;background-color:#fffbdd">`)
+				template.HTMLEscape(bw, []byte(noteLine(note)))
+				bw.WriteString("</span>\n")
+			}
+		}
+
+		if err == io.EOF {
+			break
+		}
+	}
+
+	bw.WriteString(`</pre>`)
+	return bw.Flush()
+}
+
+// htmlForPullRequest renders the pull request, with the inlined diff if
+// there is one.
+func htmlForPullRequest(pr bitbucket.PullRequest, diff *diffText, data TemplateData) (*bodyPart, error) {
+	description, err := renderMarkdown(pr.Description)
+	if err != nil {
+		return nil, err
+	}
+
+	insights, err := htmlForInsights(data.Insights)
+	if err != nil {
+		return nil, err
+	}
+
+	var b bytes.Buffer
+	err = pullRequestHTML.Execute(&b, struct {
+		Description template.HTML
+		Link        string
+		Commits     []bitbucket.Commit
+		Diffstat    string
+		DiffNote    string
+		Insights    template.HTML
+	}{
+		Description: description,
+		Link:        pr.Links.Self[0].Href,
+		Commits:     data.Commits,
+		Diffstat:    data.Diffstat,
+		DiffNote:    data.DiffNote,
+		Insights:    insights,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &bodyPart{
+		contentType: "text/html",
+		params:      map[string]string{"charset": "utf-8"},
+		write: func(w io.Writer) error {
+			if _, err := w.Write(b.Bytes()); err != nil {
+				return err
+			}
+
+			if diff != nil {
+				return renderDiff(w, diff.open(), diff.notes)
+			}
+
+			return nil
+		},
+	}, nil
+}
+
+// commentTasksHTML marks blocker comments and lists the tasks on comments.
+var commentTasksHTML = template.Must(template.New("commentTasks").Parse(`{{if .Blocker}}<p><strong style="color:#b31d28">{{if eq .State "RESOLVED"}}Blocker (resolved){{else}}Blocker{{end}}</strong></p>
+{{end}}{{.Body}}{{with .Tasks}}
+<p>Tasks:</p>
+<ul>
+{{range .}}<li>{{if eq .State "RESOLVED"}}&#9745; <del>{{.Text}}</del>{{else}}&#9744; {{.Text}}{{end}}</li>
+{{end}}</ul>{{end}}`))
+
+// htmlForComment renders the comment, preferring the HTML rendered by
+// Bitbucket, after the quote of what it replies to.
+func htmlForComment(comment bitbucket.PullRequestComment, q *quote) ([]byte, error) {
+	body := template.HTML(comment.HTML)
+	if body == "" {
+		var err error
+		if body, err = renderMarkdown(comment.Text); err != nil {
+			return nil, err
+		}
+	}
+
+	if comment.Blocker() || len(comment.Tasks) > 0 {
+		var b strings.Builder
+		err := commentTasksHTML.Execute(&b, struct {
+			Blocker bool
+			State   string
+			Body    template.HTML
+			Tasks   []bitbucket.Task
+		}{comment.Blocker(), comment.State, body, comment.Tasks})
+		if err != nil {
+			return nil, err
+		}
+		body = template.HTML(b.String())
+	}
+
+	if q != nil {
+		body = q.render() + body
+	}
+
+	return []byte(body), nil
+}
+
+// htmlForDiff renders the diff of a single file.
+func htmlForDiff(diff *diffText) *bodyPart {
+	return &bodyPart{
+		contentType: "text/html",
+		params:      map[string]string{"charset": "utf-8"},
+		write: func(w io.Writer) error {
+			return renderDiff(w, diff.open(), diff.notes)
+		},
+	}
+}
+
+// htmlForText renders plain text, such as the body of an activity message,
+// after the quote if there is one.
+func htmlForText(text string, q *quote) ([]byte, error) {
+	body := template.HTML("<p>" + template.HTMLEscapeString(text) + "</p>")
+	if q != nil {
+		body = q.render() + body
+	}
+
+	return []byte(body), nil
+}
+
+// htmlForDescription renders the changes to the description of a pull
+// request after the text introducing them.
+func htmlForDescription(text, diff string) ([]byte, error) {
+	var body bytes.Buffer
+	body.WriteString("<p>" + template.HTMLEscapeString(strings.TrimSpace(text)) + "</p>\n")
+	if diff != "" {
+		if err := renderDiff(&body, strings.NewReader(diff), nil); err != nil {
+			return nil, err
+		}
+	}
+
+	return body.Bytes(), nil
+}
+
+// htmlForChanges renders the changes of an edited comment after the text
+// introducing them, with deleted words struck out and inserted ones
+// highlighted.
+func htmlForChanges(text string, changes []difflib.Chunk) ([]byte, error) {
+	var body strings.Builder
+	body.WriteString("<p>" + template.HTMLEscapeString(strings.TrimSpace(text)) + "</p>\n")
+	body.WriteString(`<p style="white-space:pre-wrap">`)
+	for _, c := range changes {
+		text := template.HTMLEscapeString(c.Text)
+		switch c.Op {
+		case difflib.Delete:
+			body.WriteString(`<del style="color:#b31d28;background-color:#ffeef0">` + text + `</del>`)
+		case difflib.Insert:
+			body.WriteString(`<ins style="color:#22863a;background-color:#f0fff4">` + text + `</ins>`)
+		default:
+			body.WriteString(text)
+		}
+	}
+	body.WriteString("</p>")
+
+	return []byte(body.String()), nil
+}
@@ -0,0 +1,47 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestPlainTextFlowedKeepsCodeAndTables(t *testing.T) {
+	c := testComposer(t)
+	c.conf.RenderMarkdown = true
+	c.conf.Flowed = true
+	c.conf.Width = 20
+
+	src := "The frobnicator is broken in many ways.\n" +
+		"\n" +
+		"```\n" +
+		"if frob := frobnicate(x); frob > 0 {\n" +
+		"```\n" +
+		"\n" +
+		"| Frobnicator | Broken since |\n" +
+		"|---|---|\n" +
+		"| left | version 1.2.3 |\n"
+
+	text := newTextBody(c.conf, nil)
+	text.prose(c.plainText(testPullRequest(), src))
+
+	var b bytes.Buffer
+	if err := text.part().write(&b); err != nil {
+		t.Fatal(err)
+	}
+
+	want := "The frobnicator is \n" +
+		"broken in many ways.\n" +
+		"\n" +
+		"     if frob := frobnicate(x); frob > 0 {\n" +
+		"\n" +
+		"Frobnicator  Broken since\n" +
+		"-----------  -------------\n" +
+		"left         version 1.2.3\n"
+	if got := b.String(); got != want {
+		t.Errorf("flowed text:\n%q\nwant:\n%q", got, want)
+	}
+}
@@ -0,0 +1,135 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"html/template"
+	"sort"
+	"strings"
+
+	"github.com/terinjokes/mailpail/pkgs/bitbucket"
+)
+
+// Insight is a Code Insights report on the latest commit of a pull request,
+// with its annotations.
+type Insight struct {
+	bitbucket.InsightReport
+	Annotations []bitbucket.InsightAnnotation
+}
+
+// codeInsights fetches the Code Insights reports on the latest commit of the
+// pull request, with their annotations ordered by file and line. Servers
+// without Code Insights have no reports.
+func (a *app) codeInsights(ctx context.Context, pr bitbucket.PullRequest) []Insight {
+	var (
+		proj   = pr.ToRef.Repository.Project.Key
+		repo   = pr.ToRef.Repository.Slug
+		commit = pr.FromRef.LatestCommit
+	)
+
+	reports, err := a.api.InsightReports(ctx, proj, repo, commit)
+	if err != nil {
+		fmt.Printf("error fetching code insights of %s: %s\n", pullRequestItemKeyFunc(pr), err)
+		return nil
+	}
+	if len(reports) == 0 {
+		return nil
+	}
+
+	annotations, err := a.api.InsightAnnotations(ctx, proj, repo, commit)
+	if err != nil {
+		fmt.Printf("error fetching code insights of %s: %s\n", pullRequestItemKeyFunc(pr), err)
+	}
+
+	sort.SliceStable(annotations, func(i, j int) bool {
+		if annotations[i].Path != annotations[j].Path {
+			return annotations[i].Path < annotations[j].Path
+		}
+		return annotations[i].Line < annotations[j].Line
+	})
+
+	insights := make([]Insight, len(reports))
+	for i, report := range reports {
+		insights[i].InsightReport = report
+		for _, an := range annotations {
+			if an.ReportKey == report.Key {
+				insights[i].Annotations = append(insights[i].Annotations, an)
+			}
+		}
+	}
+
+	return insights
+}
+
+// annotations are the notes on lines of a diff, by the path of the file and
+// the line in its new version.
+type annotations map[annotatedLine][]string
+
+type annotatedLine struct {
+	path string
+	line int
+}
+
+// annotate indexes the annotations of the reports on lines of files.
+func annotate(insights []Insight) annotations {
+	notes := make(annotations)
+	for _, insight := range insights {
+		for _, an := range insight.Annotations {
+			if an.Line == 0 {
+				continue
+			}
+
+			note := insight.Title + ": " + an.Message
+			if an.Severity != "" {
+				note += " (" + an.Severity + ")"
+			}
+
+			at := annotatedLine{an.Path, an.Line}
+			notes[at] = append(notes[at], note)
+		}
+	}
+
+	return notes
+}
+
+// noteLine returns the line written after the line of a diff the note
+// annotates.
+func noteLine(note string) string {
+	return strings.TrimRight("    ^ "+note, " ")
+}
+
+// sevenBit reports whether the notes can be written as 7bit.
+func (n annotations) sevenBit() bool {
+	for _, notes := range n {
+		for _, note := range notes {
+			if !isSevenBit([]byte(noteLine(note))) {
+				return false
+			}
+		}
+	}
+
+	return true
+}
+
+// insightsHTML lists the reports and their annotations.
+var insightsHTML = template.Must(template.New("insights").Parse(`{{if .}}<p>Code Insights:</p>
+<ul>
+{{range .}}<li>{{if .Link}}<a href="{{.Link}}">{{.Title}}</a>{{else}}{{.Title}}{{end}}: {{.Result}}{{with .Annotations}}
+<ul>
+{{range .}}<li><code>{{.Path}}{{if .Line}}:{{.Line}}{{end}}</code>: {{.Message}}{{with .Severity}} ({{.}}){{end}}</li>
+{{end}}</ul>{{end}}</li>
+{{end}}</ul>
+{{end}}`))
+
+func htmlForInsights(insights []Insight) (template.HTML, error) {
+	var b strings.Builder
+	if err := insightsHTML.Execute(&b, insights); err != nil {
+		return "", err
+	}
+
+	return template.HTML(b.String()), nil
+}
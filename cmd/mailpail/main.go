@@ -5,17 +5,16 @@
 package main
 
 import (
-	"bytes"
 	"context"
 	"database/sql"
 	"fmt"
 	"net/http"
-	"net/mail"
 	"os"
-	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
 	"time"
 
-	"github.com/emersion/go-message/textproto"
 	_ "github.com/mattn/go-sqlite3"
 	"github.com/terinjokes/mailpail/pkgs/bitbucket"
 	"github.com/terinjokes/mailpail/pkgs/db"
@@ -52,64 +51,157 @@ func pullRequestCommentKeyFunc(pr bitbucket.PullRequest, comment bitbucket.PullR
 	)
 }
 
-func articleForPullRequest(pr bitbucket.PullRequest, diff []byte) ([]byte, error) {
-	var message bytes.Buffer
+// pullRequestCommentEditKeyFunc names the message for the n-th edit of a
+// comment.
+func pullRequestCommentEditKeyFunc(pr bitbucket.PullRequest, comment bitbucket.PullRequestComment, n int) string {
+	return fmt.Sprintf("%s.edit.%d", pullRequestCommentKeyFunc(pr, comment), n)
+}
 
-	to := &mail.Address{
-		Name:    pr.Author.User.DisplayName,
-		Address: pr.Author.User.EmailAddress,
-	}
+func pullRequestCommentDeletedKeyFunc(pr bitbucket.PullRequest, comment bitbucket.PullRequestComment) string {
+	return pullRequestCommentKeyFunc(pr, comment) + ".deleted"
+}
 
-	var h textproto.Header
-	h.Set("From", to.String())
-	h.Set("Subject", fmt.Sprintf("[%s/%s #%d] %s", pr.ToRef.Repository.Project.Key, pr.ToRef.Repository.Slug, pr.ID, pr.Title))
-	h.Set("Date", FromUnixMilli(pr.CreatedDate).Format(time.RFC1123Z))
-	h.Set("Message-Id", fmt.Sprintf("<%s@bitbucket.cfdata.org>", pullRequestItemKeyFunc(pr)))
-	h.Set("Content-Location", pr.Links.Self[0].Href)
-	h.Set("Content-Type", "text/plain")
+// pullRequestCommentTaskKeyFunc names the message for the n-th change to
+// the state of the tasks of a comment.
+func pullRequestCommentTaskKeyFunc(pr bitbucket.PullRequest, comment bitbucket.PullRequestComment, n int) string {
+	return fmt.Sprintf("%s.task.%d", pullRequestCommentKeyFunc(pr, comment), n)
+}
 
-	if err := textproto.WriteHeader(&message, h); err != nil {
-		return nil, err
-	}
+// pullRequestDescriptionKeyFunc names the message for the changes to the
+// title and description in a version of the pull request.
+func pullRequestDescriptionKeyFunc(pr bitbucket.PullRequest) string {
+	return fmt.Sprintf("%s.description.%d", pullRequestItemKeyFunc(pr), pr.Version)
+}
 
-	// TODO: implement flow=reflow
-	message.Write([]byte(pr.Description))
-	message.Write([]byte("\n\n---\n\n"))
-	message.Write(diff)
-	message.Write([]byte("-- \n"))
+// pullRequestBuildKeyFunc names the n-th message for the changes to the
+// statuses of the builds of a pull request.
+func pullRequestBuildKeyFunc(pr bitbucket.PullRequest, n int) string {
+	return fmt.Sprintf("%s.build.%d", pullRequestItemKeyFunc(pr), n)
+}
 
-	return message.Bytes(), nil
+func pullRequestActivityKeyFunc(pr bitbucket.PullRequest, activity bitbucket.PullRequestActivity) string {
+	return fmt.Sprintf("%s.%s.pr.%d.activity.%d",
+		pr.ToRef.Repository.Project.Key,
+		pr.ToRef.Repository.Slug,
+		pr.ID,
+		activity.ID,
+	)
 }
 
-func articleForPullRequestComment(pr bitbucket.PullRequest, activity bitbucket.PullRequestActivity) ([]byte, error) {
-	var message bytes.Buffer
+func pullRequestFileKeyFunc(pr bitbucket.PullRequest, part int) string {
+	return fmt.Sprintf("%s.%s.pr.%d.file.%d",
+		pr.ToRef.Repository.Project.Key,
+		pr.ToRef.Repository.Slug,
+		pr.ID,
+		part,
+	)
+}
+
+// messageKey identifies the pull request, and optionally the comment,
+// activity or part of a split diff, that a message was generated for.
+type messageKey struct {
+	Project string
+	Repo    string
+	ID      int
+	Comment int
+	// Edit, Deleted and Task name the messages for the edits and the
+	// deletion of the comment, and the changes to its tasks.
+	Edit     int
+	Deleted  bool
+	Task     int
+	Activity int
+	File     int
+	// Description is the version of the pull request a message for the
+	// changes to its description was written for.
+	Description int
+	// Build numbers the messages for the statuses of builds.
+	Build int
+}
 
-	from := &mail.Address{
-		Name:    activity.User.DisplayName,
-		Address: activity.User.EmailAddress,
+// String returns the key as generated by one of the key funcs.
+func (k messageKey) String() string {
+	s := fmt.Sprintf("%s.%s.pr.%d", k.Project, k.Repo, k.ID)
+	switch {
+	case k.Comment != 0:
+		s += fmt.Sprintf(".comment.%d", k.Comment)
+		if k.Edit != 0 {
+			s += fmt.Sprintf(".edit.%d", k.Edit)
+		} else if k.Deleted {
+			s += ".deleted"
+		} else if k.Task != 0 {
+			s += fmt.Sprintf(".task.%d", k.Task)
+		}
+	case k.Activity != 0:
+		s += fmt.Sprintf(".activity.%d", k.Activity)
+	case k.File != 0:
+		s += fmt.Sprintf(".file.%d", k.File)
+	case k.Description != 0:
+		s += fmt.Sprintf(".description.%d", k.Description)
+	case k.Build != 0:
+		s += fmt.Sprintf(".build.%d", k.Build)
 	}
 
-	var h textproto.Header
-	h.Set("From", from.String())
-	h.Set("Subject", fmt.Sprintf("Re: [%s/%s #%d] %s", pr.ToRef.Repository.Project.Key, pr.ToRef.Repository.Slug, pr.ID, pr.Title))
-	h.Set("Date", FromUnixMilli(pr.CreatedDate).Format(time.RFC1123Z))
-	h.Set("Message-Id", fmt.Sprintf("<%s@bitbucket.cfdata.org>", pullRequestCommentKeyFunc(pr, activity.Comment)))
-	h.Set("In-Reply-To", fmt.Sprintf("<%s@bitbucket.cfdata.org>", pullRequestItemKeyFunc(pr)))
-	h.Set("References", fmt.Sprintf("<%s@bitbucket.cfdata.org>", pullRequestItemKeyFunc(pr)))
-	h.Set("Content-Type", "text/plain")
+	return s
+}
+
+// PullRequest returns the pull request part of the key as PROJECT/REPO/ID.
+func (k messageKey) PullRequest() string {
+	return fmt.Sprintf("%s/%s/%d", k.Project, k.Repo, k.ID)
+}
 
-	if err := textproto.WriteHeader(&message, h); err != nil {
-		return nil, err
+var messageIDPattern = regexp.MustCompile(`^<?([^.]+)\.(.+)\.pr\.(\d+)(?:\.comment\.(\d+)(?:\.edit\.(\d+)|\.(deleted)|\.task\.(\d+))?|\.activity\.(\d+)|\.file\.(\d+)|\.description\.(\d+)|\.build\.(\d+))?@[^>]+>?$`)
+
+// parseMessageID parses a Message-Id generated from one of the key funcs.
+func parseMessageID(id string) (messageKey, bool) {
+	m := messageIDPattern.FindStringSubmatch(strings.TrimSpace(id))
+	if m == nil {
+		return messageKey{}, false
 	}
 
-	message.Write([]byte(activity.Comment.Text))
+	key := messageKey{Project: m[1], Repo: m[2]}
+	key.ID, _ = strconv.Atoi(m[3])
+	if m[4] != "" {
+		key.Comment, _ = strconv.Atoi(m[4])
+	}
+	if m[5] != "" {
+		key.Edit, _ = strconv.Atoi(m[5])
+	}
+	key.Deleted = m[6] != ""
+	if m[7] != "" {
+		key.Task, _ = strconv.Atoi(m[7])
+	}
+	if m[8] != "" {
+		key.Activity, _ = strconv.Atoi(m[8])
+	}
+	if m[9] != "" {
+		key.File, _ = strconv.Atoi(m[9])
+	}
+	if m[10] != "" {
+		key.Description, _ = strconv.Atoi(m[10])
+	}
+	if m[11] != "" {
+		key.Build, _ = strconv.Atoi(m[11])
+	}
+
+	return key, true
+}
 
-	return message.Bytes(), nil
+type app struct {
+	conf    Config
+	api     *bitbucket.API
+	db      *db.DB
+	md      maildir.Maildir
+	compose *composer
 }
 
 func main() {
 	ctx := context.Background()
 
+	cmd, args := "sync", os.Args[1:]
+	if len(args) > 0 {
+		cmd, args = args[0], args[1:]
+	}
+
 	// TODO: make the location of this config file a flag option.
 	conf, err := LoadUserConfig()
 	if err != nil {
@@ -123,6 +215,12 @@ func main() {
 		os.Exit(1)
 	}
 
+	compose, err := newComposer(conf)
+	if err != nil {
+		fmt.Printf("unable to configure messages: %s\n", err)
+		os.Exit(1)
+	}
+
 	deliveryDB, err := initDB(conf.Database)
 	if err != nil {
 		fmt.Printf("unable to create database: %s\n", err)
@@ -132,101 +230,37 @@ func main() {
 	c := &http.Client{
 		Transport: &UATransport{rt: http.DefaultTransport},
 	}
-	api := bitbucket.New(c, conf.API.Endpoint, token)
 
-	md := maildir.Maildir(conf.Maildir)
-	os.MkdirAll(filepath.Join(conf.Maildir, "tmp"), 0744)
-	os.MkdirAll(filepath.Join(conf.Maildir, "cur"), 0744)
-	os.MkdirAll(filepath.Join(conf.Maildir, "new"), 0744)
-
-	pullRequests, err := api.PullRequests(ctx, "open")
-	if err != nil {
-		fmt.Printf("error fetch pull requests: %s\n", err)
+	a := &app{
+		conf:    conf,
+		api:     bitbucket.New(c, conf.API.Endpoint, token),
+		db:      deliveryDB,
+		md:      maildir.Maildir(conf.Maildir),
+		compose: compose,
+	}
+	compose.users = func(slug string) (bitbucket.User, bool) {
+		return a.lookupUser(ctx, slug)
 	}
 
-	for _, pullRequest := range pullRequests {
-		var (
-			proj = pullRequest.ToRef.Repository.Project.Key
-			repo = pullRequest.ToRef.Repository.Slug
-			prID = pullRequest.ID
-		)
-
-		exists, err := deliveryDB.HasPullRequest(ctx, proj, repo, prID)
-		if err != nil {
-			fmt.Printf("err: %s\n", err)
-			os.Exit(-1)
-		}
-
-		if !exists {
-			diff, err := api.Diff(ctx, pullRequest.ToRef.Repository.Project.Key, pullRequest.ToRef.Repository.Slug, pullRequest.ID)
-			if err != nil {
-				fmt.Printf("err fetching diff: %s\n", err)
-				os.Exit(-1)
-			}
-
-			article, _ := articleForPullRequest(pullRequest, diff)
-
-			art, err := md.NewArticle()
-			if err != nil {
-				fmt.Printf("err: %s\n", err)
-				os.Exit(-1)
-			}
-			defer art.Close()
-
-			if _, err := art.Write(article); err != nil {
-				fmt.Printf("err: %s\n", err)
-				os.Exit(-1)
-			}
-
-			if err := deliveryDB.UpsertPullRequest(ctx, proj, repo, prID, 0); err != nil {
-				fmt.Printf("err: %s\n", err)
-				os.Exit(-1)
-			}
-		}
-
-		lastActivity, err := deliveryDB.LastActivity(ctx, proj, repo, prID)
-		if err != nil {
-			fmt.Printf("err: %s\n", err)
-			os.Exit(-1)
-		}
-
-		fmt.Printf("lastActivity: %d\n", lastActivity)
-
-		activities, err := api.PullRequestActivities(ctx, proj, repo, prID)
-		if err != nil {
-			fmt.Printf("err: %s\n", err)
-			os.Exit(-1)
-		}
+	switch cmd {
+	case "sync":
+		err = a.sync(ctx)
+	case "rules":
+		err = a.rulesCommand(ctx, args)
+	case "reindex":
+		err = a.reindex(ctx, args)
+	case "fsck":
+		err = a.fsck(ctx, args)
+	case "migrate-domain":
+		err = a.migrateDomain(ctx, args)
+	default:
+		fmt.Printf("unknown command: %s\n", cmd)
+		os.Exit(1)
+	}
 
-		for _, activity := range activities {
-			switch activity.Action {
-			case "COMMENTED":
-				if activity.ID > lastActivity {
-					article, _ := articleForPullRequestComment(pullRequest, activity)
-					art, err := md.NewArticle()
-					if err != nil {
-						fmt.Printf("err: %s\n", err)
-						os.Exit(-1)
-					}
-
-					if _, err := art.Write(article); err != nil {
-						fmt.Printf("err: %s\n", err)
-						os.Exit(-1)
-					}
-
-					if err := deliveryDB.UpsertPullRequest(ctx, proj, repo, prID, activity.ID); err != nil {
-						fmt.Printf("err: %s\n", err)
-						os.Exit(-1)
-					}
-
-					art.Close()
-				}
-
-				// TODO: check recursively for new comments under activity.Comments.Comments
-			default:
-				fmt.Printf("skipping unknown action: %s\n", activity.Action)
-			}
-		}
+	if err != nil {
+		fmt.Printf("err: %s\n", err)
+		os.Exit(-1)
 	}
 }
 
@@ -242,6 +276,72 @@ CREATE TABLE IF NOT EXISTS pulls (
   key TEXT NOT NULL PRIMARY KEY,
   last_activity INTEGER
 );
+`)
+
+	// The version of the pull request the root message was written from,
+	// added after the table. Fails harmlessly once the column exists.
+	d.Exec(`ALTER TABLE pulls ADD COLUMN version INTEGER`)
+
+	// The title and description last seen, to deliver their changes.
+	d.Exec(`ALTER TABLE pulls ADD COLUMN seen_version INTEGER`)
+	d.Exec(`ALTER TABLE pulls ADD COLUMN title TEXT`)
+	d.Exec(`ALTER TABLE pulls ADD COLUMN description TEXT`)
+
+	// The state the pull request was last synced in, to sync it once more
+	// when it is no longer open.
+	d.Exec(`ALTER TABLE pulls ADD COLUMN state TEXT`)
+
+	d.Exec(`
+CREATE TABLE IF NOT EXISTS messages (
+  message_id TEXT NOT NULL PRIMARY KEY,
+  project TEXT NOT NULL,
+  repo TEXT NOT NULL,
+  pull_request INTEGER NOT NULL,
+  folder TEXT NOT NULL,
+  filename TEXT NOT NULL
+);
+`)
+
+	// Whether a rule dropped the message, added after the table.
+	d.Exec(`ALTER TABLE messages ADD COLUMN dropped INTEGER NOT NULL DEFAULT 0`)
+
+	d.Exec(`
+CREATE TABLE IF NOT EXISTS comments (
+  pull TEXT NOT NULL,
+  comment_id INTEGER NOT NULL,
+  parent_id INTEGER NOT NULL,
+  version INTEGER NOT NULL,
+  hash TEXT NOT NULL,
+  edits INTEGER NOT NULL,
+  deleted INTEGER NOT NULL,
+  comment TEXT NOT NULL,
+  PRIMARY KEY (pull, comment_id)
+);
+`)
+
+	// The changes to the state of the tasks of each comment delivered,
+	// added after the table.
+	d.Exec(`ALTER TABLE comments ADD COLUMN tasks INTEGER NOT NULL DEFAULT 0`)
+
+	d.Exec(`
+CREATE TABLE IF NOT EXISTS builds (
+  pull TEXT NOT NULL,
+  key TEXT NOT NULL,
+  commit_id TEXT NOT NULL,
+  state TEXT NOT NULL,
+  seq INTEGER NOT NULL,
+  PRIMARY KEY (pull, key)
+);
+`)
+
+	// Users looked up for their addresses and names.
+	d.Exec(`
+CREATE TABLE IF NOT EXISTS users (
+  slug TEXT NOT NULL PRIMARY KEY,
+  name TEXT NOT NULL,
+  email TEXT NOT NULL,
+  fetched INTEGER NOT NULL
+);
 `)
 
 	return db.New(d), nil
@@ -0,0 +1,62 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"testing"
+
+	"github.com/terinjokes/mailpail/pkgs/bitbucket"
+)
+
+func TestMessageKeyRoundTrip(t *testing.T) {
+	pr := bitbucket.PullRequest{ID: 7, Version: 3}
+	pr.ToRef.Repository.Project.Key = "FOO"
+	pr.ToRef.Repository.Slug = "my.dotted.repo"
+
+	var (
+		comment  = bitbucket.PullRequestComment{ID: 11}
+		activity = bitbucket.PullRequestActivity{ID: 13}
+		base     = messageKey{Project: "FOO", Repo: "my.dotted.repo", ID: 7}
+	)
+
+	with := func(f func(k *messageKey)) messageKey {
+		k := base
+		f(&k)
+		return k
+	}
+
+	tests := []struct {
+		name string
+		key  string
+		want messageKey
+	}{
+		{"item", pullRequestItemKeyFunc(pr), base},
+		{"comment", pullRequestCommentKeyFunc(pr, comment), with(func(k *messageKey) { k.Comment = 11 })},
+		{"edit", pullRequestCommentEditKeyFunc(pr, comment, 2), with(func(k *messageKey) { k.Comment, k.Edit = 11, 2 })},
+		{"deleted", pullRequestCommentDeletedKeyFunc(pr, comment), with(func(k *messageKey) { k.Comment, k.Deleted = 11, true })},
+		{"task", pullRequestCommentTaskKeyFunc(pr, comment, 4), with(func(k *messageKey) { k.Comment, k.Task = 11, 4 })},
+		{"activity", pullRequestActivityKeyFunc(pr, activity), with(func(k *messageKey) { k.Activity = 13 })},
+		{"file", pullRequestFileKeyFunc(pr, 5), with(func(k *messageKey) { k.File = 5 })},
+		{"description", pullRequestDescriptionKeyFunc(pr), with(func(k *messageKey) { k.Description = 3 })},
+		{"build", pullRequestBuildKeyFunc(pr, 6), with(func(k *messageKey) { k.Build = 6 })},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, id := range []string{tt.key + "@bitbucket.example.com", "<" + tt.key + "@bitbucket.example.com>"} {
+				got, ok := parseMessageID(id)
+				if !ok {
+					t.Fatalf("parseMessageID(%q) did not match", id)
+				}
+				if got != tt.want {
+					t.Errorf("parseMessageID(%q) = %+v, want %+v", id, got, tt.want)
+				}
+				if s := got.String(); s != tt.key {
+					t.Errorf("String() = %q, want %q", s, tt.key)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,160 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// migrateDomain rewrites the Message-Ids of messages delivered with another
+// domain, such as the default used before it was derived from the API
+// endpoint, so later messages keep threading under them.
+func (a *app) migrateDomain(ctx context.Context, args []string) error {
+	flags := flag.NewFlagSet("migrate-domain", flag.ExitOnError)
+	dryRun := flags.Bool("n", false, "only list the messages that would be rewritten")
+	flags.Parse(args)
+
+	if flags.NArg() != 1 {
+		return fmt.Errorf("usage: mailpail migrate-domain [-n] OLD-DOMAIN")
+	}
+
+	old, new := flags.Arg(0), a.compose.domain
+	if old == new {
+		return fmt.Errorf("messages already use %s", new)
+	}
+
+	rewritten := 0
+	err := a.walkMessages(func(folder, path, id string, key messageKey) error {
+		changed, err := rewriteDomain(path, old, new, *dryRun)
+		if err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+
+		if changed {
+			fmt.Printf("%s: <%s>\n", path, key.String()+"@"+new)
+			rewritten++
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	if *dryRun {
+		fmt.Printf("%d messages to rewrite\n", rewritten)
+		return nil
+	}
+
+	records, err := a.db.RenameMessageDomain(ctx, old, new)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("rewrote %d messages, updated %d records\n", rewritten, records)
+	return nil
+}
+
+// rewriteDomain moves the Message-Ids in the header of the message, and its
+// List-Id, from the old domain to the new one, reporting whether anything
+// changed. The message is replaced in place, keeping its name and flags.
+func rewriteDomain(path, old, new string, dryRun bool) (bool, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return false, err
+	}
+
+	br := bufio.NewReader(f)
+	header, changed, err := rewriteHeader(br, old, new)
+	if err != nil || !changed || dryRun {
+		return changed, err
+	}
+
+	// Write the rewritten message into the tmp directory of its Maildir,
+	// so it can be renamed over the original.
+	tmp, err := ioutil.TempFile(filepath.Join(filepath.Dir(filepath.Dir(path)), "tmp"), "mailpail-migrate-")
+	if err != nil {
+		return false, err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	if _, err := tmp.Write(header); err != nil {
+		return false, err
+	}
+	if _, err := io.Copy(tmp, br); err != nil {
+		return false, err
+	}
+	if err := tmp.Sync(); err != nil {
+		return false, err
+	}
+	if err := tmp.Close(); err != nil {
+		return false, err
+	}
+
+	if err := os.Chmod(tmp.Name(), info.Mode()); err != nil {
+		return false, err
+	}
+	if err := os.Chtimes(tmp.Name(), info.ModTime(), info.ModTime()); err != nil {
+		return false, err
+	}
+
+	return true, os.Rename(tmp.Name(), path)
+}
+
+// rewriteHeader reads the header, up to and including the blank line ending
+// it, replacing the domain in the fields that carry it.
+func rewriteHeader(br *bufio.Reader, old, new string) ([]byte, bool, error) {
+	var (
+		b       bytes.Buffer
+		field   string
+		changed bool
+	)
+
+	for {
+		line, err := br.ReadString('\n')
+		if err != nil && err != io.EOF {
+			return nil, false, err
+		}
+
+		if strings.TrimRight(line, "\r\n") == "" {
+			b.WriteString(line)
+			return b.Bytes(), changed, nil
+		}
+
+		// Folded lines continue the field before them.
+		if line[0] != ' ' && line[0] != '\t' {
+			field = strings.ToLower(strings.TrimSpace(strings.SplitN(line, ":", 2)[0]))
+		}
+
+		rewritten := line
+		switch field {
+		case "message-id", "in-reply-to", "references":
+			rewritten = strings.ReplaceAll(line, "@"+old+">", "@"+new+">")
+		case "list-id":
+			rewritten = strings.ReplaceAll(line, "."+strings.ToLower(old)+">", "."+strings.ToLower(new)+">")
+		}
+		changed = changed || rewritten != line
+		b.WriteString(rewritten)
+
+		if err == io.EOF {
+			return b.Bytes(), changed, nil
+		}
+	}
+}
@@ -0,0 +1,173 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"fmt"
+	"html/template"
+	"strings"
+
+	"github.com/terinjokes/mailpail/pkgs/bitbucket"
+)
+
+const quoteDate = "Mon, 2 Jan 2006 at 15:04"
+
+// quote is the comment, or the diff hunk of an inline comment, that a reply
+// responds to, itself quoting its parent.
+type quote struct {
+	attribution string
+	lines       []string
+	html        template.HTML
+	parent      *quote
+}
+
+// quote returns the quote for the last comment of the thread, which starts
+// with a comment of the activity, or nil if there is nothing to quote.
+func (c *composer) quote(pr bitbucket.PullRequest, activity bitbucket.PullRequestActivity, thread []bitbucket.PullRequestComment) (*quote, error) {
+	var (
+		depth  = c.conf.Quote.depth()
+		lines  = c.conf.Quote.lines()
+		quotes []*quote
+	)
+
+	// Collect the quotes closest to the comment first.
+	for i := len(thread) - 2; i >= 0 && len(quotes) < depth; i-- {
+		q, err := c.commentQuote(pr, thread[i], lines)
+		if err != nil {
+			return nil, err
+		}
+
+		quotes = append(quotes, q)
+	}
+
+	if len(quotes) < depth {
+		if q := hunkQuote(activity, lines); q != nil {
+			quotes = append(quotes, q)
+		}
+	}
+
+	var q *quote
+	for i := len(quotes) - 1; i >= 0; i-- {
+		quotes[i].parent = q
+		q = quotes[i]
+	}
+
+	return q, nil
+}
+
+// commentQuote quotes up to max lines of the comment.
+func (c *composer) commentQuote(pr bitbucket.PullRequest, comment bitbucket.PullRequestComment, max int) (*quote, error) {
+	html, err := renderMarkdown(strings.Join(quoteLines(comment.Text, max), "\n"))
+	if err != nil {
+		return nil, err
+	}
+
+	return &quote{
+		attribution: fmt.Sprintf("On %s, %s wrote:", FromUnixMilli(comment.CreatedDate).Format(quoteDate), comment.Author.DisplayName),
+		lines:       quoteLines(c.plainText(pr, comment.Text), max),
+		html:        html,
+	}, nil
+}
+
+// quoteLines returns up to max lines of the text, marking any left out.
+func quoteLines(text string, max int) []string {
+	lines := strings.Split(strings.TrimRight(strings.ReplaceAll(text, "\r\n", "\n"), "\n"), "\n")
+	if len(lines) > max {
+		lines = append(lines[:max:max], "[...]")
+	}
+
+	return lines
+}
+
+// hunkQuote quotes the lines of the diff up to the line an inline comment
+// is anchored to.
+func hunkQuote(activity bitbucket.PullRequestActivity, max int) *quote {
+	anchor := activity.CommentAnchor
+	if anchor == nil || activity.Diff == nil {
+		return nil
+	}
+
+	var (
+		lines []string
+		end   = -1
+	)
+
+	for _, hunk := range activity.Diff.Hunks {
+		lines = append(lines, fmt.Sprintf("@@ -%d,%d +%d,%d @@", hunk.SourceLine, hunk.SourceSpan, hunk.DestinationLine, hunk.DestinationSpan))
+
+		for _, segment := range hunk.Segments {
+			prefix := " "
+			switch segment.Type {
+			case "ADDED":
+				prefix = "+"
+			case "REMOVED":
+				prefix = "-"
+			}
+
+			for _, l := range segment.Lines {
+				lines = append(lines, prefix+l.Line)
+
+				anchored := l.Destination == anchor.Line && segment.Type != "REMOVED"
+				if anchor.FileType == "FROM" {
+					anchored = l.Source == anchor.Line && segment.Type != "ADDED"
+				}
+				if anchored {
+					end = len(lines)
+				}
+			}
+		}
+	}
+
+	if end < 0 {
+		end = len(lines)
+	}
+
+	start := end - max
+	if start < 0 {
+		start = 0
+	}
+	lines = lines[start:end]
+
+	return &quote{
+		attribution: fmt.Sprintf("On %s line %d:", anchor.Path, anchor.Line),
+		lines:       lines,
+		html:        template.HTML("<pre>" + template.HTMLEscapeString(strings.Join(lines, "\n")) + "</pre>"),
+	}
+}
+
+// text returns the attribution followed by the quoted lines.
+func (q *quote) text() string {
+	var lines []string
+	if q.parent != nil {
+		lines = append(strings.Split(strings.TrimSuffix(q.parent.text(), "\n"), "\n"), "")
+	}
+	lines = append(lines, q.lines...)
+
+	var b strings.Builder
+	b.WriteString(q.attribution + "\n")
+	for _, line := range lines {
+		switch {
+		case line == "":
+			b.WriteString(">\n")
+		case strings.HasPrefix(line, ">"):
+			b.WriteString(">" + line + "\n")
+		default:
+			b.WriteString("> " + line + "\n")
+		}
+	}
+
+	return b.String()
+}
+
+// render returns the attribution followed by the quote as a blockquote.
+func (q *quote) render() template.HTML {
+	var parent template.HTML
+	if q.parent != nil {
+		parent = q.parent.render()
+	}
+
+	return template.HTML("<p>"+template.HTMLEscapeString(q.attribution)+"</p>\n<blockquote>\n") +
+		parent + q.html + "\n</blockquote>\n"
+}
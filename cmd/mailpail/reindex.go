@@ -0,0 +1,234 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/terinjokes/mailpail/pkgs/db"
+	"github.com/terinjokes/mailpail/pkgs/maildir"
+)
+
+// indexedPullRequest records the messages found in the Maildir for a pull
+// request.
+type indexedPullRequest struct {
+	messageKey
+	root       bool
+	comments   map[int]bool
+	activities map[int]bool
+
+	// version is the version of the pull request the root message was
+	// written from, if it records one, and state the state of the pull
+	// request in the message fetched last.
+	version    int
+	hasVersion bool
+	state      string
+	fetched    time.Time
+}
+
+const reindexUsage = `usage: mailpail reindex
+
+Rebuilds the delivery database from the messages in the Maildir and its
+folders. The last activity delivered is recovered from the messages found,
+and the version and state of each pull request from their X-Mailpail-Version
+and X-Mailpail-State headers.
+
+The title and description last seen, comment versions, task states and
+builds are not recovered. The next sync records them again without
+delivering messages, so edits, task changes, description changes and builds
+from while the database was lost are not delivered.
+`
+
+// reindex rebuilds the delivery database from the messages in the Maildir,
+// so sync resumes without delivering duplicates after the database is lost.
+func (a *app) reindex(ctx context.Context, args []string) error {
+	flags := flag.NewFlagSet("reindex", flag.ExitOnError)
+	flags.Usage = func() { fmt.Fprint(flags.Output(), reindexUsage) }
+	flags.Parse(args)
+
+	pulls := make(map[string]*indexedPullRequest)
+
+	err := a.walkMessages(func(folder, path, id string, key messageKey) error {
+		k := key.PullRequest()
+		p, ok := pulls[k]
+		if !ok {
+			p = &indexedPullRequest{
+				messageKey: messageKey{Project: key.Project, Repo: key.Repo, ID: key.ID},
+				comments:   make(map[int]bool),
+				activities: make(map[int]bool),
+			}
+			pulls[k] = p
+		}
+
+		if err := p.readHeader(path, key); err != nil {
+			fmt.Printf("%s: unable to read header: %s\n", path, err)
+		}
+
+		switch {
+		case key.Edit != 0 || key.Deleted || key.Task != 0 || key.Description != 0 || key.Build != 0:
+		case key.Comment != 0:
+			p.comments[key.Comment] = true
+		case key.Activity != 0:
+			p.activities[key.Activity] = true
+		case key.File != 0:
+		default:
+			p.root = true
+		}
+
+		return a.db.RecordMessage(ctx, db.Message{
+			MessageID:   id,
+			Project:     key.Project,
+			Repo:        key.Repo,
+			PullRequest: key.ID,
+			Folder:      folder,
+			Filename:    maildir.UniqueName(path),
+		})
+	})
+	if err != nil {
+		return err
+	}
+
+	keys := make([]string, 0, len(pulls))
+	for k := range pulls {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		p := pulls[k]
+
+		// Message-Ids name comments, but the database tracks the last
+		// delivered activity, so map them back through the activities.
+		// Other activities are named directly.
+		activities, err := a.api.PullRequestActivities(ctx, p.Project, p.Repo, p.ID)
+		if err != nil {
+			fmt.Printf("%s: skipping, unable to fetch activities: %s\n", k, err)
+			continue
+		}
+
+		lastActivity := 0
+		for _, activity := range activities {
+			found := p.activities[activity.ID]
+			if activity.Action == "COMMENTED" {
+				found = p.comments[activity.Comment.ID]
+			}
+
+			if found && activity.ID > lastActivity {
+				lastActivity = activity.ID
+			}
+		}
+
+		if err := a.db.UpsertPullRequest(ctx, p.Project, p.Repo, p.ID, lastActivity); err != nil {
+			return err
+		}
+		if p.hasVersion {
+			if err := a.db.SetRootVersion(ctx, p.Project, p.Repo, p.ID, p.version); err != nil {
+				return err
+			}
+		}
+		if p.state != "" {
+			if err := a.db.SetState(ctx, p.Project, p.Repo, p.ID, p.state); err != nil {
+				return err
+			}
+		}
+
+		fmt.Printf("%s: root message: %t, comments: %d, activities: %d, last activity: %d, state: %s\n", k, p.root, len(p.comments), len(p.activities), lastActivity, p.state)
+	}
+
+	return nil
+}
+
+// readHeader recovers the version and state of the pull request from the
+// header of one of its messages.
+func (p *indexedPullRequest) readHeader(path string, key messageKey) error {
+	h, err := readHeader(path)
+	if err != nil {
+		return err
+	}
+
+	if key == p.messageKey {
+		if v, err := strconv.Atoi(h.Get("X-Mailpail-Version")); err == nil {
+			p.version, p.hasVersion = v, true
+		}
+	}
+
+	// Messages written before X-Mailpail-Fetched was added sort first.
+	fetched, _ := time.Parse(time.RFC1123Z, h.Get("X-Mailpail-Fetched"))
+	if state := h.Get("X-Mailpail-State"); state != "" && (p.state == "" || !fetched.Before(p.fetched)) {
+		p.state, p.fetched = state, fetched
+	}
+
+	return nil
+}
+
+// walkMessages calls fn for every message generated by mailpail in the
+// Maildir and its folders, with the name of the folder, the path to the
+// message and its Message-Id.
+func (a *app) walkMessages(fn func(folder, path, id string, key messageKey) error) error {
+	folders, err := a.md.Folders()
+	if err != nil {
+		return err
+	}
+
+	for _, md := range append([]maildir.Maildir{a.md}, folders...) {
+		var folder string
+		if md != a.md {
+			folder = strings.TrimPrefix(filepath.Base(string(md)), ".")
+		}
+
+		paths, err := md.Messages()
+		if err != nil {
+			return err
+		}
+
+		for _, path := range paths {
+			id, err := readMessageID(path)
+			if err != nil {
+				fmt.Printf("%s: skipping, unable to read header: %s\n", path, err)
+				continue
+			}
+
+			key, ok := parseMessageID(id)
+			if !ok {
+				continue
+			}
+
+			if err := fn(folder, path, id, key); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+func readMessageID(path string) (string, error) {
+	h, err := readHeader(path)
+	if err != nil {
+		return "", err
+	}
+
+	return strings.Trim(strings.TrimSpace(h.Get("Message-Id")), "<>"), nil
+}
+
+func readHeader(path string) (textproto.Header, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return textproto.Header{}, err
+	}
+	defer f.Close()
+
+	return textproto.ReadHeader(bufio.NewReader(f))
+}
@@ -0,0 +1,146 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/terinjokes/mailpail/pkgs/bitbucket"
+	"github.com/terinjokes/mailpail/pkgs/db"
+	"github.com/terinjokes/mailpail/pkgs/maildir"
+	"github.com/terinjokes/mailpail/pkgs/rules"
+)
+
+// updateRoot rewrites the root message of the pull request if it was
+// updated since the message was written. Root messages written before
+// versions were recorded are assumed to be current.
+func (a *app) updateRoot(ctx context.Context, msg rules.Message, pr bitbucket.PullRequest) error {
+	var (
+		proj = pr.ToRef.Repository.Project.Key
+		repo = pr.ToRef.Repository.Slug
+	)
+
+	version, ok, err := a.db.RootVersion(ctx, proj, repo, pr.ID)
+	if err != nil {
+		return err
+	}
+
+	if ok && version == pr.Version {
+		return nil
+	}
+
+	if ok {
+		if err := a.rewriteRoot(ctx, msg, pr); err != nil {
+			return err
+		}
+	}
+
+	return a.db.SetRootVersion(ctx, proj, repo, pr.ID, pr.Version)
+}
+
+// rewriteRoot replaces the root message of the pull request where it was
+// delivered, keeping the flags the user has set on it. Root messages that
+// were removed from the Maildir are not delivered again.
+func (a *app) rewriteRoot(ctx context.Context, msg rules.Message, pr bitbucket.PullRequest) error {
+	id := a.compose.messageID(pullRequestItemKeyFunc(pr))
+
+	record, ok, err := a.db.Message(ctx, id)
+	if err != nil {
+		return err
+	}
+
+	md := a.md
+	if record.Folder != "" {
+		md = md.Folder(record.Folder)
+	}
+
+	if record.Dropped {
+		// The rule dropping the message may drop it still, and if not it
+		// is not delivered again either.
+		return nil
+	}
+
+	var path string
+	if ok {
+		path, err = md.Find(record.Filename)
+	}
+	switch {
+	case !ok || os.IsNotExist(err):
+		fmt.Printf("<%s>: root message not found, not rewriting\n", id)
+		return nil
+	case err != nil:
+		return err
+	}
+
+	d, err := a.pullRequestDiff(ctx, pr)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+
+	commits, err := a.pullRequestCommits(ctx, pr)
+	if err != nil {
+		return err
+	}
+
+	// The message stays where it is, but the rule may add header fields.
+	msg.Action = "OPENED"
+	rule, _ := a.conf.Rules.Evaluate(msg)
+
+	art, err := md.NewArticle(maildir.WithReplace(path), maildir.WithModTime(FromUnixMilli(pr.CreatedDate)))
+	if err != nil {
+		return err
+	}
+
+	err = writeArticle(art, rule.Headers, func(w io.Writer, fields map[string]string) error {
+		return a.compose.pullRequest(w, fields, pr, d, commits)
+	})
+	if err != nil {
+		return err
+	}
+
+	record.Filename = art.Name()
+	return a.db.RecordMessage(ctx, record)
+}
+
+// trackDescription delivers a message for the changes to the title and the
+// description of the pull request since they were last seen, and records
+// them as seen. They are only recorded when first seen.
+func (a *app) trackDescription(ctx context.Context, msg rules.Message, pr bitbucket.PullRequest) error {
+	var (
+		proj = pr.ToRef.Repository.Project.Key
+		repo = pr.ToRef.Repository.Slug
+	)
+
+	last, ok, err := a.db.LastDescription(ctx, proj, repo, pr.ID)
+	if err != nil {
+		return err
+	}
+
+	if ok && last.Version == pr.Version {
+		return nil
+	}
+
+	if ok && (last.Title != pr.Title || last.Description != pr.Description) {
+		msg.Action = "UPDATED"
+		opts := a.articleOptions(pr, pr.Author.User, pr.UpdatedDate)
+		err := a.deliver(ctx, msg, a.compose.messageID(pullRequestDescriptionKeyFunc(pr)), func(w io.Writer, fields map[string]string) error {
+			return a.compose.description(w, fields, pr, last.Title, last.Description)
+		}, opts...)
+		if err != nil && !errors.Is(err, errDropped) {
+			return err
+		}
+	}
+
+	return a.db.SetDescription(ctx, proj, repo, pr.ID, db.Description{
+		Version:     pr.Version,
+		Title:       pr.Title,
+		Description: pr.Description,
+	})
+}
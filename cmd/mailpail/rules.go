@@ -0,0 +1,158 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"mime"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/emersion/go-message/mail"
+	"github.com/terinjokes/mailpail/pkgs/bitbucket"
+	"github.com/terinjokes/mailpail/pkgs/rules"
+)
+
+// ruleMessage describes the pull request to the rules engine. The Action is
+// left for the caller to fill in for each message.
+func (a *app) ruleMessage(ctx context.Context, pr bitbucket.PullRequest) (rules.Message, error) {
+	var (
+		proj = pr.ToRef.Repository.Project.Key
+		repo = pr.ToRef.Repository.Slug
+	)
+
+	m := rules.Message{
+		Project: proj,
+		Repo:    repo,
+		ID:      pr.ID,
+		Author:  pr.Author.User.Slug,
+		Branch:  pr.ToRef.DisplayID,
+	}
+
+	for _, r := range pr.Reviewers {
+		m.Reviewers = append(m.Reviewers, r.User.Slug)
+	}
+
+	if a.conf.Rules.NeedPaths() {
+		changes, err := a.api.Changes(ctx, proj, repo, pr.ID)
+		if err != nil {
+			return rules.Message{}, fmt.Errorf("fetching changes: %w", err)
+		}
+
+		for _, c := range changes {
+			m.Paths = append(m.Paths, c.Path.ToString)
+			if c.SrcPath != nil {
+				m.Paths = append(m.Paths, c.SrcPath.ToString)
+			}
+		}
+	}
+
+	if a.conf.Rules.NeedLabels() {
+		labels, err := a.api.Labels(ctx, proj, repo)
+		if err != nil {
+			return rules.Message{}, fmt.Errorf("fetching labels: %w", err)
+		}
+
+		for _, l := range labels {
+			m.Labels = append(m.Labels, l.Name)
+		}
+	}
+
+	return m, nil
+}
+
+// addFields adds the header fields of a rule to a message header.
+func addFields(h *mail.Header, fields map[string]string) {
+	keys := make([]string, 0, len(fields))
+	for k := range fields {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		h.Add(k, mime.QEncoding.Encode("utf-8", fields[k]))
+	}
+}
+
+func (a *app) rulesCommand(ctx context.Context, args []string) error {
+	if len(args) != 2 || args[0] != "test" {
+		return fmt.Errorf("usage: mailpail rules test PROJECT/REPO/ID")
+	}
+
+	proj, repo, id, err := parsePullRequestRef(args[1])
+	if err != nil {
+		return err
+	}
+
+	pr, err := a.api.PullRequest(ctx, proj, repo, id)
+	if err != nil {
+		return err
+	}
+
+	msg, err := a.ruleMessage(ctx, pr)
+	if err != nil {
+		return err
+	}
+
+	msg.Action = "OPENED"
+	fmt.Printf("%s: %s\n", msg.Action, describeRule(a.conf.Rules.Evaluate(msg)))
+
+	activities, err := a.api.PullRequestActivities(ctx, proj, repo, id)
+	if err != nil {
+		return err
+	}
+
+	for _, activity := range activities {
+		msg.Action = activity.Action
+		fmt.Printf("%s (activity %d): %s\n", msg.Action, activity.ID, describeRule(a.conf.Rules.Evaluate(msg)))
+	}
+
+	return nil
+}
+
+func describeRule(rule rules.Rule, ok bool) string {
+	if !ok {
+		return "no rule matched"
+	}
+
+	var actions []string
+	if rule.Drop {
+		actions = append(actions, "drop")
+	}
+	if rule.Folder != "" {
+		actions = append(actions, fmt.Sprintf("folder %q", rule.Folder))
+	}
+	if rule.Flags != "" {
+		actions = append(actions, fmt.Sprintf("flags %q", rule.Flags))
+	}
+	for k, v := range rule.Headers {
+		actions = append(actions, fmt.Sprintf("header %s: %s", k, v))
+	}
+	sort.Strings(actions)
+
+	if len(actions) == 0 {
+		actions = append(actions, "deliver")
+	}
+
+	return fmt.Sprintf("rule %q: %s", rule.Name, strings.Join(actions, ", "))
+}
+
+// parsePullRequestRef parses a pull request reference in the form
+// PROJECT/REPO/ID.
+func parsePullRequestRef(ref string) (proj, repo string, id int, err error) {
+	parts := strings.Split(ref, "/")
+	if len(parts) != 3 {
+		return "", "", 0, fmt.Errorf("invalid pull request %q, expected PROJECT/REPO/ID", ref)
+	}
+
+	id, err = strconv.Atoi(parts[2])
+	if err != nil {
+		return "", "", 0, fmt.Errorf("invalid pull request id %q: %w", parts[2], err)
+	}
+
+	return parts[0], parts[1], id, nil
+}
@@ -0,0 +1,98 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"html/template"
+	"strings"
+
+	"github.com/terinjokes/mailpail/pkgs/bitbucket"
+)
+
+// Where the summary of the review is placed in messages.
+const (
+	summaryHeader = "header"
+	summaryFooter = "footer"
+)
+
+// Summary is the state of the review of a pull request when a message about
+// it was written.
+type Summary struct {
+	// State is the state of the pull request: OPEN, MERGED or DECLINED.
+	State string
+	// Reviewers are the reviewers of the pull request, with their Status:
+	// APPROVED, NEEDS_WORK or UNAPPROVED.
+	Reviewers []bitbucket.PullRequestParticipant
+	// OpenTasks and ResolvedTasks count the tasks on the pull request.
+	OpenTasks     int
+	ResolvedTasks int
+	// Merge is whether the pull request can be merged, and the merge checks
+	// preventing it. It is nil when it is not known.
+	Merge *bitbucket.MergeStatus
+}
+
+// summary summarizes the review of the pull request, with the merge status
+// recorded for it.
+func (c *composer) summary(pr bitbucket.PullRequest) *Summary {
+	s := &Summary{
+		State:         pr.State,
+		Reviewers:     pr.Reviewers,
+		OpenTasks:     propertyCount(pr, "openTaskCount"),
+		ResolvedTasks: propertyCount(pr, "resolvedTaskCount"),
+	}
+
+	if status, ok := c.merges[pullRequestItemKeyFunc(pr)]; ok {
+		s.Merge = &status
+	}
+
+	return s
+}
+
+// setMergeStatus records whether the pull request can be merged, for the
+// summaries of the messages about it.
+func (c *composer) setMergeStatus(pr bitbucket.PullRequest, status bitbucket.MergeStatus) {
+	c.merges[pullRequestItemKeyFunc(pr)] = status
+}
+
+// propertyCount returns a count from the properties of the pull request, or
+// zero if it is missing.
+func propertyCount(pr bitbucket.PullRequest, name string) int {
+	n, _ := pr.Properties[name].(float64)
+	return int(n)
+}
+
+// fetchMergeStatus fetches the merge checks of an open pull request for the
+// summaries of its messages, when they are enabled. They are left out of the
+// summaries if they cannot be fetched.
+func (a *app) fetchMergeStatus(ctx context.Context, pr bitbucket.PullRequest) {
+	if a.conf.Message.Summary == "" || pr.State != "OPEN" {
+		return
+	}
+
+	status, err := a.api.Merge(ctx, pr.ToRef.Repository.Project.Key, pr.ToRef.Repository.Slug, pr.ID)
+	if err != nil {
+		fmt.Printf("error fetching merge status of %s: %s\n", pullRequestItemKeyFunc(pr), err)
+		return
+	}
+
+	a.compose.setMergeStatus(pr, status)
+}
+
+// summaryHTML renders the summary written by the summary template, above or
+// below the body of the message.
+func (c *composer) summaryHTML(summary string) (head, foot string) {
+	if summary == "" {
+		return "", ""
+	}
+
+	pre := `<pre style="font-family:monospace">` + template.HTMLEscapeString(strings.TrimRight(summary, "\n")) + `</pre>`
+	if c.conf.Summary == summaryHeader {
+		return pre + "\n<hr>\n", ""
+	}
+
+	return "", "\n<hr>\n" + pre
+}
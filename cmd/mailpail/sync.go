@@ -0,0 +1,469 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"time"
+
+	"github.com/terinjokes/mailpail/pkgs/bitbucket"
+	"github.com/terinjokes/mailpail/pkgs/db"
+	"github.com/terinjokes/mailpail/pkgs/maildir"
+	"github.com/terinjokes/mailpail/pkgs/rules"
+)
+
+// tmpMaxAge is how long a file may linger in tmp before it is considered
+// an abandoned delivery.
+const tmpMaxAge = 36 * time.Hour
+
+func (a *app) sync(ctx context.Context) error {
+	if err := a.md.Init(); err != nil {
+		return err
+	}
+
+	folders, err := a.md.Folders()
+	if err != nil {
+		return err
+	}
+
+	for _, md := range append(folders, a.md) {
+		if err := md.CleanTmp(tmpMaxAge); err != nil {
+			return fmt.Errorf("cleaning tmp: %w", err)
+		}
+	}
+
+	pullRequests, err := a.api.PullRequests(ctx, "open")
+	if err != nil {
+		fmt.Printf("error fetch pull requests: %s\n", err)
+		return nil
+	}
+
+	listed := make(map[messageKey]bool)
+	for _, pullRequest := range pullRequests {
+		if err := a.syncPullRequest(ctx, pullRequest); err != nil {
+			return err
+		}
+
+		listed[messageKey{
+			Project: pullRequest.ToRef.Repository.Project.Key,
+			Repo:    pullRequest.ToRef.Repository.Slug,
+			ID:      pullRequest.ID,
+		}] = true
+	}
+
+	return a.syncUnlisted(ctx, listed)
+}
+
+// syncUnlisted syncs the pull requests that were open when last synced but
+// are no longer listed as open, fetching them one by one, so that they are
+// seen merged or declined. Once seen closed they are not fetched again,
+// unless they are reopened and listed once more.
+func (a *app) syncUnlisted(ctx context.Context, listed map[messageKey]bool) error {
+	pulls, err := a.db.PullRequests(ctx)
+	if err != nil {
+		return err
+	}
+
+	for _, p := range pulls {
+		key := messageKey{Project: p.Project, Repo: p.Repo, ID: p.ID}
+		if listed[key] || (p.State != "" && p.State != "OPEN") {
+			continue
+		}
+
+		pullRequest, err := a.api.PullRequest(ctx, p.Project, p.Repo, p.ID)
+		switch {
+		case errors.Is(err, bitbucket.ErrNotFound):
+			// Deleted pull requests have nothing more to deliver.
+			if err := a.db.SetState(ctx, p.Project, p.Repo, p.ID, "DELETED"); err != nil {
+				return err
+			}
+			continue
+		case err != nil:
+			fmt.Printf("error fetching pull request %s: %s\n", key.PullRequest(), err)
+			continue
+		}
+
+		if err := a.syncPullRequest(ctx, pullRequest); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (a *app) syncPullRequest(ctx context.Context, pullRequest bitbucket.PullRequest) error {
+	var (
+		proj = pullRequest.ToRef.Repository.Project.Key
+		repo = pullRequest.ToRef.Repository.Slug
+		prID = pullRequest.ID
+	)
+
+	msg, err := a.ruleMessage(ctx, pullRequest)
+	if err != nil {
+		return err
+	}
+
+	a.fetchMergeStatus(ctx, pullRequest)
+
+	exists, err := a.db.HasPullRequest(ctx, proj, repo, prID)
+	if err != nil {
+		return err
+	}
+
+	if !exists {
+		if err := a.deliverPullRequest(ctx, msg, pullRequest); err != nil {
+			return err
+		}
+
+		if err := a.db.UpsertPullRequest(ctx, proj, repo, prID, 0); err != nil {
+			return err
+		}
+
+		if err := a.db.SetRootVersion(ctx, proj, repo, prID, pullRequest.Version); err != nil {
+			return err
+		}
+	} else if a.conf.Message.UpdateRoot {
+		if err := a.updateRoot(ctx, msg, pullRequest); err != nil {
+			return err
+		}
+	}
+
+	if err := a.trackDescription(ctx, msg, pullRequest); err != nil {
+		return err
+	}
+
+	if err := a.trackBuilds(ctx, msg, pullRequest, exists); err != nil {
+		return err
+	}
+
+	lastActivity, err := a.db.LastActivity(ctx, proj, repo, prID)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("lastActivity: %d\n", lastActivity)
+
+	activities, err := a.api.PullRequestActivities(ctx, proj, repo, prID)
+	if err != nil {
+		return err
+	}
+
+	// Activities are returned newest first, but the last delivered activity
+	// must only ever move forward, or the newer activities are delivered
+	// again by the next sync.
+	sort.Slice(activities, func(i, j int) bool {
+		return activities[i].ID < activities[j].ID
+	})
+
+	for _, activity := range activities {
+		switch activity.Action {
+		case "COMMENTED":
+			// Edits and deletions are found by trackComments.
+			if activity.CommentAction == "EDITED" || activity.CommentAction == "DELETED" {
+				continue
+			}
+
+			thread := []bitbucket.PullRequestComment{activity.Comment}
+			if activity.ID > lastActivity {
+				if err := a.deliverComment(ctx, msg, pullRequest, activity, thread); err != nil && !errors.Is(err, errDropped) {
+					return err
+				}
+
+				if err := a.db.UpsertPullRequest(ctx, proj, repo, prID, activity.ID); err != nil {
+					return err
+				}
+			}
+
+			if err := a.deliverReplies(ctx, msg, pullRequest, activity, thread); err != nil {
+				return err
+			}
+		default:
+			if _, ok := activityKinds[activity.Action]; ok && a.conf.Message.Activities {
+				if activity.ID > lastActivity {
+					if err := a.deliverActivity(ctx, msg, pullRequest, activity); err != nil && !errors.Is(err, errDropped) {
+						return err
+					}
+
+					if err := a.db.UpsertPullRequest(ctx, proj, repo, prID, activity.ID); err != nil {
+						return err
+					}
+				}
+				continue
+			}
+
+			fmt.Printf("skipping unknown action: %s\n", activity.Action)
+		}
+	}
+
+	if err := a.trackComments(ctx, msg, pullRequest, activities); err != nil {
+		return err
+	}
+
+	return a.db.SetState(ctx, proj, repo, prID, pullRequest.State)
+}
+
+// deliverPullRequest delivers the root message of the pull request, and the
+// messages its diff is split into.
+func (a *app) deliverPullRequest(ctx context.Context, msg rules.Message, pr bitbucket.PullRequest) error {
+	d, err := a.pullRequestDiff(ctx, pr)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+
+	if err := a.deliverRoot(ctx, msg, pr, d); err != nil && !errors.Is(err, errDropped) {
+		return err
+	}
+
+	if d.Mode != diffSplit {
+		return nil
+	}
+
+	for i := range d.Files {
+		if err := a.deliverDiffFile(ctx, msg, pr, d, i); err != nil && !errors.Is(err, errDropped) {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// deliverRoot delivers the root message of the pull request.
+func (a *app) deliverRoot(ctx context.Context, msg rules.Message, pr bitbucket.PullRequest, d *pullRequestDiff) error {
+	commits, err := a.pullRequestCommits(ctx, pr)
+	if err != nil {
+		return err
+	}
+
+	msg.Action = "OPENED"
+	opts := a.articleOptions(pr, pr.Author.User, pr.CreatedDate)
+	return a.deliver(ctx, msg, a.compose.messageID(pullRequestItemKeyFunc(pr)), func(w io.Writer, fields map[string]string) error {
+		return a.compose.pullRequest(w, fields, pr, d, commits)
+	}, opts...)
+}
+
+func (a *app) pullRequestCommits(ctx context.Context, pr bitbucket.PullRequest) ([]bitbucket.Commit, error) {
+	commits, err := a.api.Commits(ctx, pr.ToRef.Repository.Project.Key, pr.ToRef.Repository.Slug, pr.ID)
+	if err != nil {
+		return nil, fmt.Errorf("fetching commits: %w", err)
+	}
+
+	return commits, nil
+}
+
+// pullRequestDiff fetches the diff of the pull request, spooled for
+// mailing, and the Code Insights annotating it. The caller must close it.
+func (a *app) pullRequestDiff(ctx context.Context, pr bitbucket.PullRequest) (*pullRequestDiff, error) {
+	r, err := a.api.Diff(ctx, pr.ToRef.Repository.Project.Key, pr.ToRef.Repository.Slug, pr.ID)
+	if err != nil {
+		return nil, fmt.Errorf("fetching diff: %w", err)
+	}
+	defer r.Close()
+
+	d, err := a.conf.Message.Diff.spool(r)
+	if err != nil {
+		return nil, fmt.Errorf("fetching diff: %w", err)
+	}
+
+	d.Insights = a.codeInsights(ctx, pr)
+	return d, nil
+}
+
+// deliverDiffFile delivers the message for the i-th file of a split diff.
+func (a *app) deliverDiffFile(ctx context.Context, msg rules.Message, pr bitbucket.PullRequest, d *pullRequestDiff, i int) error {
+	msg.Action = "OPENED"
+	opts := a.articleOptions(pr, pr.Author.User, pr.CreatedDate)
+	return a.deliver(ctx, msg, a.compose.messageID(pullRequestFileKeyFunc(pr, i+1)), func(w io.Writer, fields map[string]string) error {
+		return a.compose.diffFile(w, fields, pr, d, i)
+	}, opts...)
+}
+
+// deliverComment delivers a message for the last comment of the thread,
+// which starts with the comment of the activity.
+func (a *app) deliverComment(ctx context.Context, msg rules.Message, pr bitbucket.PullRequest, activity bitbucket.PullRequestActivity, thread []bitbucket.PullRequestComment) error {
+	comment := thread[len(thread)-1]
+
+	msg.Action = activity.Action
+	opts := a.articleOptions(pr, comment.Author, comment.CreatedDate)
+	return a.deliver(ctx, msg, a.compose.messageID(pullRequestCommentKeyFunc(pr, comment)), func(w io.Writer, fields map[string]string) error {
+		return a.compose.comment(w, fields, pr, activity, thread, a.commentAttachments(ctx, pr, comment))
+	}, opts...)
+}
+
+// deliverReplies delivers the replies to the last comment of the thread, and
+// their replies in turn. Replies have no activity of their own, so those
+// already delivered are found in the database.
+func (a *app) deliverReplies(ctx context.Context, msg rules.Message, pr bitbucket.PullRequest, activity bitbucket.PullRequestActivity, thread []bitbucket.PullRequestComment) error {
+	for _, reply := range thread[len(thread)-1].Comments {
+		replies := append(thread[:len(thread):len(thread)], reply)
+
+		delivered, err := a.db.HasMessage(ctx, a.compose.messageID(pullRequestCommentKeyFunc(pr, reply)))
+		if err != nil {
+			return err
+		}
+
+		if !delivered {
+			if err := a.deliverComment(ctx, msg, pr, activity, replies); err != nil && !errors.Is(err, errDropped) {
+				return err
+			}
+		}
+
+		if err := a.deliverReplies(ctx, msg, pr, activity, replies); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// findComment finds the thread of a comment, or a reply to one, in the
+// activities.
+func findComment(activities []bitbucket.PullRequestActivity, id int) (bitbucket.PullRequestActivity, []bitbucket.PullRequestComment, bool) {
+	var find func(thread []bitbucket.PullRequestComment) []bitbucket.PullRequestComment
+	find = func(thread []bitbucket.PullRequestComment) []bitbucket.PullRequestComment {
+		comment := thread[len(thread)-1]
+		if comment.ID == id {
+			return thread
+		}
+
+		for _, reply := range comment.Comments {
+			if t := find(append(thread[:len(thread):len(thread)], reply)); t != nil {
+				return t
+			}
+		}
+
+		return nil
+	}
+
+	for _, activity := range activities {
+		if activity.Action != "COMMENTED" {
+			continue
+		}
+
+		if thread := find([]bitbucket.PullRequestComment{activity.Comment}); thread != nil {
+			return activity, thread, true
+		}
+	}
+
+	return bitbucket.PullRequestActivity{}, nil, false
+}
+
+// deliverActivity delivers a message for an activity other than a comment,
+// such as an approval or merge.
+func (a *app) deliverActivity(ctx context.Context, msg rules.Message, pr bitbucket.PullRequest, activity bitbucket.PullRequestActivity) error {
+	msg.Action = activity.Action
+	opts := a.articleOptions(pr, activity.User, activity.CreatedDate)
+	return a.deliver(ctx, msg, a.compose.messageID(pullRequestActivityKeyFunc(pr, activity)), func(w io.Writer, fields map[string]string) error {
+		return a.compose.activity(w, fields, pr, activity)
+	}, opts...)
+}
+
+// articleOptions returns the delivery options for a message about the pull
+// request written by author at date. Messages by the configured user are
+// marked as seen, pull requests awaiting their review are flagged, and
+// declined pull requests are trashed.
+func (a *app) articleOptions(pr bitbucket.PullRequest, author bitbucket.User, date int64) []maildir.ArticleOption {
+	var flags string
+	if me := a.conf.API.User; me != "" {
+		if author.Slug == me {
+			flags += "S"
+		}
+
+		for _, r := range pr.Reviewers {
+			if r.User.Slug == me {
+				flags += "F"
+			}
+		}
+	}
+
+	if pr.State == "DECLINED" {
+		flags += "T"
+	}
+
+	return []maildir.ArticleOption{
+		maildir.WithFlags(flags),
+		maildir.WithModTime(FromUnixMilli(date)),
+	}
+}
+
+// errDropped is returned by deliver for messages dropped by a rule.
+var errDropped = errors.New("dropped by a rule")
+
+// deliver writes an article into the Maildir, applying the actions of the
+// first rule matching the message, and records where it was delivered. The
+// article is written by write, with the header fields added by the rule. The
+// article has been durably delivered once deliver returns without error, and
+// only then may the caller record its progress in the database. Messages
+// dropped by the rule are recorded as dropped, and errDropped is returned, so
+// the caller may record its progress too.
+func (a *app) deliver(ctx context.Context, m rules.Message, id string, write func(w io.Writer, fields map[string]string) error, opts ...maildir.ArticleOption) error {
+	rule, _ := a.conf.Rules.Evaluate(m)
+	if rule.Drop {
+		err := a.db.RecordMessage(ctx, db.Message{
+			MessageID:   id,
+			Project:     m.Project,
+			Repo:        m.Repo,
+			PullRequest: m.ID,
+			Dropped:     true,
+		})
+		if err != nil {
+			return err
+		}
+
+		return errDropped
+	}
+
+	md := a.md
+	if rule.Folder != "" {
+		md = md.Folder(rule.Folder)
+		if err := md.Init(); err != nil {
+			return err
+		}
+	}
+
+	art, err := md.NewArticle(append(opts, maildir.WithFlags(rule.Flags))...)
+	if err != nil {
+		return err
+	}
+
+	if err := writeArticle(art, rule.Headers, write); err != nil {
+		return err
+	}
+
+	return a.db.RecordMessage(ctx, db.Message{
+		MessageID:   id,
+		Project:     m.Project,
+		Repo:        m.Repo,
+		PullRequest: m.ID,
+		Folder:      rule.Folder,
+		Filename:    art.Name(),
+	})
+}
+
+// writeArticle writes the article with the fields added by a rule, and
+// delivers it. The article is aborted if it cannot be written.
+func writeArticle(art *maildir.Article, fields map[string]string, write func(w io.Writer, fields map[string]string) error) error {
+	bw := bufio.NewWriter(art)
+	if err := write(bw, fields); err != nil {
+		art.Abort()
+		return err
+	}
+
+	if err := bw.Flush(); err != nil {
+		art.Abort()
+		return err
+	}
+
+	if err := art.Close(); err != nil {
+		return fmt.Errorf("delivering article: %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,149 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"context"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/terinjokes/mailpail/pkgs/bitbucket"
+	"github.com/terinjokes/mailpail/pkgs/rules"
+)
+
+// taskChange is a task that was resolved or reopened, by the user at the
+// date in milliseconds.
+type taskChange struct {
+	task bitbucket.Task
+	by   bitbucket.User
+	date int64
+}
+
+// resolved reports whether the change resolved the task.
+func (t taskChange) resolved() bool {
+	return t.task.State == "RESOLVED"
+}
+
+// taskChanges returns the changes to the state of the tasks of the comment
+// since it was last seen: the comment itself if it is a blocker, and the
+// tasks on it in earlier versions of Bitbucket Server. Tasks seen for the
+// first time are not changes.
+func taskChanges(old, comment bitbucket.PullRequestComment) []taskChange {
+	var changes []taskChange
+
+	if comment.Blocker() && old.State != "" && old.State != comment.State {
+		by := comment.Author
+		date := comment.UpdatedDate
+		if comment.State == "RESOLVED" && comment.Resolver != nil {
+			by = *comment.Resolver
+			if comment.ResolvedDate != 0 {
+				date = comment.ResolvedDate
+			}
+		}
+
+		changes = append(changes, taskChange{
+			task: bitbucket.Task{
+				ID:          comment.ID,
+				Author:      comment.Author,
+				Text:        comment.Text,
+				State:       comment.State,
+				CreatedDate: comment.CreatedDate,
+			},
+			by:   by,
+			date: date,
+		})
+	}
+
+	states := make(map[int]string, len(old.Tasks))
+	for _, task := range old.Tasks {
+		states[task.ID] = task.State
+	}
+
+	for _, task := range comment.Tasks {
+		if state, ok := states[task.ID]; !ok || state == task.State {
+			continue
+		}
+
+		// Earlier versions do not say who changed the task, or when.
+		changes = append(changes, taskChange{
+			task: task,
+			by:   task.Author,
+			date: time.Now().UnixNano() / int64(time.Millisecond),
+		})
+	}
+
+	return changes
+}
+
+// taskAction returns the action of messages for the change.
+func taskAction(change taskChange) string {
+	if change.resolved() {
+		return "RESOLVED"
+	}
+	return "REOPENED"
+}
+
+// deliverTask delivers the n-th message for the changes to the tasks of the
+// last comment of the thread.
+func (a *app) deliverTask(ctx context.Context, msg rules.Message, pr bitbucket.PullRequest, thread []bitbucket.PullRequestComment, change taskChange, n int) error {
+	comment := thread[len(thread)-1]
+
+	msg.Action = taskAction(change)
+	opts := a.articleOptions(pr, change.by, change.date)
+	return a.deliver(ctx, msg, a.compose.messageID(pullRequestCommentTaskKeyFunc(pr, comment, n)), func(w io.Writer, fields map[string]string) error {
+		return a.compose.task(w, fields, pr, thread, change, n)
+	}, opts...)
+}
+
+// task writes the n-th message for the changes to the tasks of the last
+// comment of the thread, threaded under it and quoting the task.
+func (c *composer) task(w io.Writer, fields map[string]string, pr bitbucket.PullRequest, thread []bitbucket.PullRequestComment, change taskChange, n int) error {
+	comment := thread[len(thread)-1]
+
+	q, err := c.commentQuote(pr, bitbucket.PullRequestComment{
+		Author:      change.task.Author,
+		Text:        change.task.Text,
+		CreatedDate: change.task.CreatedDate,
+	}, c.conf.Quote.lines())
+	if err != nil {
+		return err
+	}
+
+	data := c.templateData(pr)
+	data.Comment = comment
+	data.Text = c.plainText(pr, comment.Text)
+	data.Task = change.task
+	if c.conf.Quote.depth() > 0 {
+		data.Quote = q.text()
+	} else {
+		q = nil
+	}
+
+	rich := func() (*bodyPart, error) {
+		body, err := c.execute("task", "body", data)
+		if err != nil {
+			return nil, err
+		}
+
+		b, err := htmlForText(strings.TrimPrefix(body, data.Quote), q)
+		if err != nil {
+			return nil, err
+		}
+
+		return htmlPart(b), nil
+	}
+
+	return c.reply(w, fields, data, replyMessage{
+		kind:     "task",
+		key:      pullRequestCommentTaskKeyFunc(pr, comment, n),
+		author:   change.by,
+		action:   taskAction(change),
+		date:     change.date,
+		archived: commentURL(pr, comment),
+		thread:   threadKeys(pr, thread),
+		rich:     rich,
+	})
+}
@@ -0,0 +1,284 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/template"
+
+	"github.com/terinjokes/mailpail/pkgs/bitbucket"
+	difflib "github.com/terinjokes/mailpail/pkgs/diff"
+	"github.com/terinjokes/mailpail/pkgs/flowed"
+)
+
+// TemplateData is the data available to message templates.
+type TemplateData struct {
+	// Project and Repo identify the repository the pull request targets.
+	Project string
+	Repo    string
+
+	PullRequest bitbucket.PullRequest
+	// Description is the description of the pull request, and Text the
+	// text of the comment, rendered as plain text when enabled.
+	Description string
+	Text        string
+	// Activity is the activity the message is for. It is empty for the
+	// pull request root message.
+	Activity bitbucket.PullRequestActivity
+	// Comment is the comment of a comment activity, or a reply to it.
+	Comment bitbucket.PullRequestComment
+	// Quote is the attribution and quote of the comment, or the diff of an
+	// inline comment, replied to, or of a deleted comment.
+	Quote string
+	// Changes are the words changed by an edit of the comment, deleted
+	// words in [-...-] and inserted ones in {+...+}.
+	Changes string
+	// OldTitle is the title before it changed, and DescriptionDiff a
+	// unified diff of the changes to the description, in messages for
+	// updates to the pull request only.
+	OldTitle        string
+	DescriptionDiff string
+	// DiffNote describes what was not inlined of a large diff, in the root
+	// message only.
+	DiffNote string
+	// Diffstat summarizes the diff like "git diff --stat", in the root
+	// message only.
+	Diffstat string
+	// Commits are the commits of the pull request, oldest first, in the
+	// root message only.
+	Commits []bitbucket.Commit
+	// Insights are the Code Insights reports on the latest commit, in the
+	// root message and messages for builds.
+	Insights []Insight
+	// Build is the build whose status changed, in messages for builds.
+	Build bitbucket.BuildStatus
+	// Task is the task that was resolved or reopened, in messages for
+	// tasks. The task of a blocker comment is the comment.
+	Task bitbucket.Task
+	// File is the file of a message that a large diff is split into, the
+	// Part of Parts.
+	File  difflib.FileStat
+	Part  int
+	Parts int
+	// Summary summarizes the review of the pull request, when enabled.
+	Summary *Summary
+}
+
+// baseTemplate is parsed into every kind of message, for templates shared
+// between them. The summary is written above the body or in the signature,
+// and is never flowed.
+const baseTemplate = `{{define "title"}}[{{.Project}}/{{.Repo}} #{{.PullRequest.ID}}] {{.PullRequest.Title}}{{end}}
+{{- define "summary"}}{{with .Summary}}State: {{.State}}
+Reviewers:{{range .Reviewers}}
+  {{if .Approved}}[x]{{else}}[ ]{{end}} {{.User.DisplayName}} ({{.Status}}){{else}} none{{end}}
+Tasks: {{.OpenTasks}} open, {{.ResolvedTasks}} resolved
+{{with .Merge}}Merge checks: {{if .CanMerge}}passed{{else if .Conflicted}}conflicted{{else}}failed{{end}}{{range .Vetoes}}
+  - {{.SummaryMessage}}{{end}}
+{{end}}{{end}}{{end}}
+{{- define "insights"}}{{range .}}  {{.Title}}: {{.Result}}{{range .Annotations}}
+    {{.Path}}{{if .Line}}:{{.Line}}{{end}}: {{.Message}}{{with .Severity}} ({{.}}){{end}}{{end}}
+{{end}}{{end}}`
+
+// builtinTemplates are the templates for each kind of message, which can be
+// replaced by files named after the kind in the templates directory. Each
+// defines a "subject" and a "body", which is flowed when enabled. Messages
+// with a diff also have a "patch" written before the diff and a "trailer"
+// after it, which are never flowed.
+var builtinTemplates = map[string]string{
+	"pullRequest": `{{define "subject"}}{{template "title" .}}{{end}}
+{{- define "body"}}{{.Description}}{{end}}
+{{- define "patch"}}
+
+---
+
+{{range .Commits}}{{.DisplayID}} {{.Subject}} ({{or .Author.DisplayName .Author.Name}})
+{{end}}{{if .Commits}}
+{{end}}{{with .Diffstat}}{{.}}
+{{end}}{{with .Insights}}Code Insights:
+{{template "insights" .}}
+{{end}}{{end}}
+{{- define "trailer"}}{{with .DiffNote}}{{.}}
+{{end}}{{"-- "}}
+{{end}}`,
+	"diffFile": `{{define "subject"}}Re: {{template "title" .}} ({{.Part}}/{{.Parts}} {{.File.Name}}){{end}}
+{{- define "trailer"}}{{"-- "}}
+{{end}}`,
+	"comment": `{{define "subject"}}Re: {{template "title" .}}{{if .Comment.Blocker}} [blocker]{{end}}{{end}}
+{{- define "body"}}{{with .Quote}}{{.}}
+{{end}}{{if .Comment.Blocker}}[BLOCKER{{if eq .Comment.State "RESOLVED"}}, resolved{{end}}] {{end}}{{.Text}}
+{{- with .Comment.Tasks}}
+
+Tasks:{{range .}}
+  {{if eq .State "RESOLVED"}}[x]{{else}}[ ]{{end}} {{.Text}}{{end}}{{end}}{{end}}`,
+	"edited": `{{define "subject"}}Re: {{template "title" .}} [edited]{{end}}
+{{- define "body"}}{{.Comment.Author.DisplayName}} edited their comment:
+
+{{.Changes}}{{end}}`,
+	"deleted": `{{define "subject"}}Re: {{template "title" .}} [deleted]{{end}}
+{{- define "body"}}{{with .Quote}}{{.}}
+{{end}}The comment was deleted.{{end}}`,
+	"description": `{{define "subject"}}Re: {{template "title" .}} [description updated]{{end}}
+{{- define "body"}}{{with .OldTitle}}The title changed from "{{.}}".
+{{end}}{{if .DescriptionDiff}}The description changed:
+{{end}}{{end}}
+{{- define "patch"}}{{with .DescriptionDiff}}
+{{.}}{{end}}{{end}}`,
+	"task": `{{define "subject"}}Re: {{template "title" .}} [task {{if eq .Task.State "RESOLVED"}}resolved{{else}}reopened{{end}}]{{end}}
+{{- define "body"}}{{with .Quote}}{{.}}
+{{end}}The task was {{if eq .Task.State "RESOLVED"}}resolved{{else}}reopened{{end}}.{{end}}`,
+	"build": `{{define "subject"}}Re: {{template "title" .}} [{{or .Build.Name .Build.Key}} {{.Build.State}}]{{end}}
+{{- define "body"}}{{or .Build.Name .Build.Key}} is {{.Build.State}} for {{printf "%.7s" .PullRequest.FromRef.LatestCommit}}.
+{{- with .Build.Description}}
+
+{{.}}{{end}}{{with .Build.URL}}
+
+{{.}}{{end}}
+{{end}}
+{{- define "patch"}}{{with .Insights}}
+Code Insights:
+{{template "insights" .}}{{end}}{{end}}`,
+	"approved":   activityTemplate("approved the pull request."),
+	"unapproved": activityTemplate("removed their approval."),
+	"reviewed":   activityTemplate("marked the pull request as needing work."),
+	"merged":     activityTemplate("merged the pull request."),
+	"declined":   activityTemplate("declined the pull request."),
+	"reopened":   activityTemplate("reopened the pull request."),
+}
+
+// activityKinds maps the actions of activities delivered as messages to the
+// kind of template used for them.
+var activityKinds = map[string]string{
+	"APPROVED":   "approved",
+	"UNAPPROVED": "unapproved",
+	"REVIEWED":   "reviewed",
+	"MERGED":     "merged",
+	"DECLINED":   "declined",
+	"REOPENED":   "reopened",
+}
+
+func activityTemplate(verb string) string {
+	return `{{define "subject"}}Re: {{template "title" .}}{{end}}
+{{- define "body"}}{{.Activity.User.DisplayName}} ` + verb + `{{end}}`
+}
+
+// composer builds messages from templates.
+type composer struct {
+	conf ConfigMessage
+	// user is the slug of the user the messages are for.
+	user string
+	// host is the host of the API endpoint messages are fetched from, and
+	// domain the domain of their Message-Ids.
+	host, domain string
+	templates    map[string]*template.Template
+	// merges are the merge statuses of the pull requests, by key, for the
+	// summaries of their messages.
+	merges map[string]bitbucket.MergeStatus
+	// users looks up users by slug, for their addresses and the names of
+	// those mentioned. Users are not looked up when it is nil.
+	users func(slug string) (bitbucket.User, bool)
+}
+
+// newComposer loads the built-in templates, replacing them with any found in
+// the configured templates directory. Messages are composed for the
+// configured API user.
+func newComposer(config Config) (*composer, error) {
+	conf := config.Message
+	if err := conf.validate(); err != nil {
+		return nil, err
+	}
+
+	host, err := config.API.host()
+	if err != nil {
+		return nil, err
+	}
+
+	domain, err := config.domain()
+	if err != nil {
+		return nil, err
+	}
+
+	c := &composer{
+		conf:      conf,
+		user:      config.API.User,
+		host:      host,
+		domain:    domain,
+		templates: make(map[string]*template.Template),
+		merges:    make(map[string]bitbucket.MergeStatus),
+	}
+
+	for kind, text := range builtinTemplates {
+		t := template.Must(template.New(kind).Parse(baseTemplate))
+		template.Must(t.Parse(text))
+
+		if conf.Templates != "" {
+			name := filepath.Join(conf.Templates, kind+".tmpl")
+			b, err := ioutil.ReadFile(name)
+			switch {
+			case os.IsNotExist(err):
+			case err != nil:
+				return nil, err
+			default:
+				if _, err := t.Parse(string(b)); err != nil {
+					return nil, fmt.Errorf("parsing %s: %w", name, err)
+				}
+			}
+		}
+
+		c.templates[kind] = t
+	}
+
+	return c, nil
+}
+
+// messageID returns the Message-Id, without angle brackets, for a key.
+func (c *composer) messageID(key string) string {
+	return key + "@" + c.domain
+}
+
+// execute executes the named template for a kind of message. Templates that
+// are not defined produce no output.
+func (c *composer) execute(kind, name string, data TemplateData) (string, error) {
+	t := c.templates[kind].Lookup(name)
+	if t == nil {
+		return "", nil
+	}
+
+	var b bytes.Buffer
+	if err := t.Execute(&b, data); err != nil {
+		return "", fmt.Errorf("executing %s template %q: %w", kind, name, err)
+	}
+
+	return b.String(), nil
+}
+
+// subject executes the subject template, joining it onto a single line.
+func (c *composer) subject(kind string, data TemplateData) (string, error) {
+	s, err := c.execute(kind, "subject", data)
+	if err != nil {
+		return "", err
+	}
+
+	s = strings.NewReplacer("\r", "", "\n", " ", flowed.Fixed, "").Replace(s)
+	return strings.TrimSpace(s), nil
+}
+
+func (c *composer) templateData(pr bitbucket.PullRequest) TemplateData {
+	data := TemplateData{
+		Project:     pr.ToRef.Repository.Project.Key,
+		Repo:        pr.ToRef.Repository.Slug,
+		PullRequest: pr,
+		Description: c.plainText(pr, pr.Description),
+	}
+	if c.conf.Summary != "" {
+		data.Summary = c.summary(pr)
+	}
+
+	return data
+}
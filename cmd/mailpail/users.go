@@ -0,0 +1,146 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/mail"
+	"time"
+
+	"github.com/terinjokes/mailpail/pkgs/bitbucket"
+	"github.com/terinjokes/mailpail/pkgs/db"
+)
+
+// userMaxAge is how long users looked up are cached for.
+const userMaxAge = 24 * time.Hour
+
+// lookupUser returns the user with the slug, from the database if they
+// were looked up recently, or else from Bitbucket. Users that cannot be
+// looked up are not found.
+func (a *app) lookupUser(ctx context.Context, slug string) (bitbucket.User, bool) {
+	if slug == "" {
+		return bitbucket.User{}, false
+	}
+
+	cached, ok, err := a.db.User(ctx, slug)
+	if err != nil {
+		fmt.Printf("error looking up user %s: %s\n", slug, err)
+		return bitbucket.User{}, false
+	}
+	if ok && time.Since(time.Unix(cached.Fetched, 0)) < userMaxAge {
+		return directoryUser(cached)
+	}
+
+	user, err := a.api.User(ctx, slug)
+	switch {
+	case errors.Is(err, bitbucket.ErrNotFound):
+		// Users that do not exist are cached too, so they are not
+		// looked up for every message.
+	case err != nil:
+		fmt.Printf("error looking up user %s: %s\n", slug, err)
+		if ok {
+			return directoryUser(cached)
+		}
+		return bitbucket.User{}, false
+	}
+
+	cached = db.User{
+		Slug:    slug,
+		Name:    user.DisplayName,
+		Email:   user.EmailAddress,
+		Fetched: time.Now().Unix(),
+	}
+	if err := a.db.UpsertUser(ctx, cached); err != nil {
+		fmt.Printf("error caching user %s: %s\n", slug, err)
+	}
+
+	return directoryUser(cached)
+}
+
+func directoryUser(u db.User) (bitbucket.User, bool) {
+	if u.Name == "" && u.Email == "" {
+		return bitbucket.User{}, false
+	}
+
+	return bitbucket.User{
+		Slug:         u.Slug,
+		Name:         u.Slug,
+		DisplayName:  u.Name,
+		EmailAddress: u.Email,
+	}, true
+}
+
+// unknownUser is the local part of the address of users with neither a
+// slug nor a name.
+const unknownUser = "unknown"
+
+// address returns the address of the user: their configured alias, their
+// address in Bitbucket, as looked up if missing from the user given, or
+// else an address at noreply.<host>, as service accounts and users hiding
+// their address have none.
+func (c *composer) address(user bitbucket.User) *mail.Address {
+	if alias, ok := c.conf.Aliases[user.Slug]; ok {
+		if addr, err := mail.ParseAddress(alias); err == nil {
+			if addr.Name == "" {
+				addr.Name = user.DisplayName
+			}
+			return addr
+		}
+	}
+
+	addr := &mail.Address{
+		Name:    user.DisplayName,
+		Address: user.EmailAddress,
+	}
+	if addr.Address != "" {
+		return addr
+	}
+
+	if found, ok := c.lookupUser(user.Slug); ok {
+		if addr.Name == "" {
+			addr.Name = found.DisplayName
+		}
+		addr.Address = found.EmailAddress
+	}
+
+	if addr.Address == "" {
+		slug := user.Slug
+		if slug == "" {
+			slug = user.Name
+		}
+		if slug == "" {
+			// Such as the author of an activity whose user was removed.
+			slug = unknownUser
+		}
+		addr.Address = slug + "@noreply." + c.host
+	}
+
+	return addr
+}
+
+// mentionName returns the name of a user mentioned by slug, looking them up
+// if they are not one of the names given, or else the slug.
+func (c *composer) mentionName(names map[string]string, slug string) string {
+	if name := names[slug]; name != "" {
+		return name
+	}
+
+	if found, ok := c.lookupUser(slug); ok && found.DisplayName != "" {
+		return found.DisplayName
+	}
+
+	return slug
+}
+
+// lookupUser looks up the user with the slug, when a directory is set.
+func (c *composer) lookupUser(slug string) (bitbucket.User, bool) {
+	if c.users == nil || slug == "" {
+		return bitbucket.User{}, false
+	}
+
+	return c.users(slug)
+}
@@ -0,0 +1,37 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"testing"
+
+	"github.com/terinjokes/mailpail/pkgs/bitbucket"
+)
+
+func TestAddress(t *testing.T) {
+	c := testComposer(t)
+	c.conf.Aliases = map[string]string{"bot": "CI <ci@example.com>"}
+
+	tests := []struct {
+		name string
+		user bitbucket.User
+		want string
+	}{
+		{"email", bitbucket.User{Slug: "jdoe", DisplayName: "Jane Doe", EmailAddress: "jane@example.com"}, `"Jane Doe" <jane@example.com>`},
+		{"alias", bitbucket.User{Slug: "bot", DisplayName: "Build Bot", EmailAddress: "bot@example.com"}, `"CI" <ci@example.com>`},
+		{"slug", bitbucket.User{Slug: "jdoe", DisplayName: "Jane Doe"}, `"Jane Doe" <jdoe@noreply.bitbucket.example.com>`},
+		{"name", bitbucket.User{Name: "jdoe"}, "<jdoe@noreply.bitbucket.example.com>"},
+		{"unknown", bitbucket.User{DisplayName: "Former User"}, `"Former User" <unknown@noreply.bitbucket.example.com>`},
+		{"empty", bitbucket.User{}, "<unknown@noreply.bitbucket.example.com>"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := c.address(tt.user).String(); got != tt.want {
+				t.Errorf("address() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
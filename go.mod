@@ -6,5 +6,6 @@ require (
 	github.com/emersion/go-message v0.14.0
 	github.com/google/uuid v1.3.0
 	github.com/mattn/go-sqlite3 v1.14.8
+	github.com/yuin/goldmark v1.4.1
 	olympos.io/encoding/edn v0.0.0-20201019073823-d3554ca0b0a3
 )
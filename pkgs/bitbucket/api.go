@@ -7,10 +7,15 @@ package bitbucket
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"net/http"
 	"net/url"
+	"reflect"
+	"strconv"
+	"strings"
 )
 
 type API struct {
@@ -31,14 +36,29 @@ func New(client Doer, endpoint, token string) *API {
 	}
 }
 
-func (a *API) PullRequests(ctx context.Context, state string) ([]PullRequest, error) {
-	q := url.Values{}
-	q.Set("state", state)
-	u, err := url.Parse(a.api + "/dashboard/pull-requests")
+func (a *API) get(ctx context.Context, path string, q url.Values) (*http.Response, error) {
+	return a.getURL(ctx, a.api+path, q)
+}
+
+// rest returns the endpoint of another REST API of the server, such as
+// "build-status/1.0", next to the core API the client was created for.
+func (a *API) rest(name string) string {
+	base := a.api
+	if i := strings.LastIndex(base, "/api/"); i >= 0 {
+		base = base[:i]
+	}
+
+	return base + "/" + name
+}
+
+func (a *API) getURL(ctx context.Context, rawurl string, q url.Values) (*http.Response, error) {
+	u, err := url.Parse(rawurl)
 	if err != nil {
 		return nil, err
 	}
-	u.RawQuery = q.Encode()
+	if q != nil {
+		u.RawQuery = q.Encode()
+	}
 
 	req, err := http.NewRequest("GET", u.String(), nil)
 	if err != nil {
@@ -47,59 +67,159 @@ func (a *API) PullRequests(ctx context.Context, state string) ([]PullRequest, er
 	req.Header.Add("Authorization", "Bearer "+a.token)
 
 	req = req.WithContext(ctx)
-	resp, err := a.client.Do(req)
+	return a.client.Do(req)
+}
+
+// values fetches every page of a paged resource and appends their values to
+// v, a pointer to a slice. An error is returned unless every page was
+// fetched.
+func (a *API) values(ctx context.Context, path string, q url.Values, v interface{}) error {
+	return a.valuesURL(ctx, a.api+path, q, v)
+}
+
+func (a *API) valuesURL(ctx context.Context, rawurl string, q url.Values, v interface{}) error {
+	out := reflect.ValueOf(v).Elem()
+
+	page := url.Values{}
+	for k, vs := range q {
+		page[k] = vs
+	}
+
+	start := 0
+	for {
+		page.Set("start", strconv.Itoa(start))
+
+		bbresp, err := a.page(ctx, rawurl, page)
+		if err != nil {
+			return err
+		}
+
+		values := reflect.New(out.Type())
+		if len(bbresp.Values) > 0 {
+			if err := json.Unmarshal(bbresp.Values, values.Interface()); err != nil {
+				return err
+			}
+		}
+		out.Set(reflect.AppendSlice(out, values.Elem()))
+
+		if bbresp.IsLastPage {
+			return nil
+		}
+		if bbresp.NextPageStart <= start {
+			return fmt.Errorf("fetching %s: page at %d has no next page", rawurl, start)
+		}
+		start = bbresp.NextPageStart
+	}
+}
+
+// page fetches a page of a paged resource.
+func (a *API) page(ctx context.Context, rawurl string, q url.Values) (Response, error) {
+	resp, err := a.getURL(ctx, rawurl, q)
 	if err != nil {
-		return nil, err
+		return Response{}, err
 	}
 	defer resp.Body.Close()
 
-	var (
-		bbresp       Response
-		pullRequests []PullRequest
-	)
+	if resp.StatusCode != http.StatusOK {
+		return Response{}, fmt.Errorf("fetching %s: %s", rawurl, resp.Status)
+	}
 
+	var bbresp Response
 	if err := json.NewDecoder(resp.Body).Decode(&bbresp); err != nil {
-		return nil, err
+		return Response{}, err
 	}
 
-	if err := json.Unmarshal(bbresp.Values, &pullRequests); err != nil {
+	if len(bbresp.Errors) > 0 {
+		return Response{}, fmt.Errorf("fetching %s: %s", rawurl, bbresp.Errors[0].Message)
+	}
+
+	return bbresp, nil
+}
+
+func (a *API) PullRequests(ctx context.Context, state string) ([]PullRequest, error) {
+	q := url.Values{}
+	q.Set("state", state)
+
+	var pullRequests []PullRequest
+	if err := a.values(ctx, "/dashboard/pull-requests", q, &pullRequests); err != nil {
 		return nil, err
 	}
 
 	return pullRequests, nil
 }
 
-func (a *API) PullRequestActivities(ctx context.Context, proj, slug string, id int) ([]PullRequestActivity, error) {
-	req, err := http.NewRequest("GET", a.api+fmt.Sprintf("/projects/%s/repos/%s/pull-requests/%d/activities", proj, slug, id), nil)
+func (a *API) PullRequest(ctx context.Context, proj, slug string, id int) (PullRequest, error) {
+	resp, err := a.get(ctx, fmt.Sprintf("/projects/%s/repos/%s/pull-requests/%d", proj, slug, id), nil)
 	if err != nil {
+		return PullRequest{}, err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		return PullRequest{}, ErrNotFound
+	default:
+		return PullRequest{}, fmt.Errorf("fetching pull request %d: %s", id, resp.Status)
+	}
+
+	var pr PullRequest
+	if err := json.NewDecoder(resp.Body).Decode(&pr); err != nil {
+		return PullRequest{}, err
+	}
+
+	return pr, nil
+}
+
+// PullRequestActivities returns the activities of the pull request, with
+// comments also rendered as HTML.
+func (a *API) PullRequestActivities(ctx context.Context, proj, slug string, id int) ([]PullRequestActivity, error) {
+	q := url.Values{}
+	q.Set("markup", "true")
+
+	var activities []PullRequestActivity
+	if err := a.values(ctx, fmt.Sprintf("/projects/%s/repos/%s/pull-requests/%d/activities", proj, slug, id), q, &activities); err != nil {
 		return nil, err
 	}
-	req.Header.Add("Authorization", "Bearer "+a.token)
 
-	req = req.WithContext(ctx)
-	resp, err := a.client.Do(req)
-	if err != nil {
+	return activities, nil
+}
+
+// Changes returns the files modified by the pull request, from every page,
+// so rules on paths see all of them.
+func (a *API) Changes(ctx context.Context, proj, slug string, id int) ([]Change, error) {
+	var changes []Change
+	if err := a.values(ctx, fmt.Sprintf("/projects/%s/repos/%s/pull-requests/%d/changes", proj, slug, id), nil, &changes); err != nil {
 		return nil, err
 	}
-	defer resp.Body.Close()
 
-	var (
-		bbresp     Response
-		activities []PullRequestActivity
-	)
+	return changes, nil
+}
 
-	if err := json.NewDecoder(resp.Body).Decode(&bbresp); err != nil {
+// Commits returns every commit of the pull request, newest first, from all
+// pages.
+func (a *API) Commits(ctx context.Context, proj, slug string, id int) ([]Commit, error) {
+	var commits []Commit
+	if err := a.values(ctx, fmt.Sprintf("/projects/%s/repos/%s/pull-requests/%d/commits", proj, slug, id), nil, &commits); err != nil {
 		return nil, err
 	}
 
-	if err := json.Unmarshal(bbresp.Values, &activities); err != nil {
+	return commits, nil
+}
+
+// Labels returns the labels applied to the repository.
+func (a *API) Labels(ctx context.Context, proj, slug string) ([]Label, error) {
+	var labels []Label
+	if err := a.values(ctx, fmt.Sprintf("/projects/%s/repos/%s/labels", proj, slug), nil, &labels); err != nil {
 		return nil, err
 	}
 
-	return activities, nil
+	return labels, nil
 }
 
-func (a *API) Diff(ctx context.Context, proj, slug string, id int) ([]byte, error) {
+// Diff returns the diff of the pull request as text. The caller must close
+// the returned reader.
+func (a *API) Diff(ctx context.Context, proj, slug string, id int) (io.ReadCloser, error) {
 	req, err := http.NewRequest("GET", a.api+fmt.Sprintf("/projects/%s/repos/%s/pull-requests/%d/diff", proj, slug, id), nil)
 
 	if err != nil {
@@ -113,7 +233,136 @@ func (a *API) Diff(ctx context.Context, proj, slug string, id int) ([]byte, erro
 	if err != nil {
 		return nil, err
 	}
+
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("diff of pull request %d: %s", id, resp.Status)
+	}
+
+	return resp.Body, nil
+}
+
+var (
+	// ErrTooLarge is returned for attachments larger than the limit.
+	ErrTooLarge = errors.New("attachment is too large")
+	// ErrNotFound is returned for users and pull requests that do not
+	// exist.
+	ErrNotFound = errors.New("not found")
+)
+
+// User returns the user with the slug.
+func (a *API) User(ctx context.Context, slug string) (User, error) {
+	resp, err := a.get(ctx, "/users/"+url.PathEscape(slug), nil)
+	if err != nil {
+		return User{}, err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		return User{}, ErrNotFound
+	default:
+		return User{}, fmt.Errorf("fetching user %s: %s", slug, resp.Status)
+	}
+
+	var user User
+	if err := json.NewDecoder(resp.Body).Decode(&user); err != nil {
+		return User{}, err
+	}
+
+	return user, nil
+}
+
+// Attachment returns the content of an attachment to the repository, and
+// its type as reported by the server. Attachments larger than max bytes
+// are not read.
+func (a *API) Attachment(ctx context.Context, proj, slug, id string, max int64) ([]byte, string, error) {
+	resp, err := a.get(ctx, fmt.Sprintf("/projects/%s/repos/%s/attachments/%s", proj, slug, url.PathEscape(id)), nil)
+	if err != nil {
+		return nil, "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, "", fmt.Errorf("fetching attachment %s: %s", id, resp.Status)
+	}
+
+	if resp.ContentLength > max {
+		return nil, "", ErrTooLarge
+	}
+
+	data, err := ioutil.ReadAll(io.LimitReader(resp.Body, max+1))
+	if err != nil {
+		return nil, "", err
+	}
+	if int64(len(data)) > max {
+		return nil, "", ErrTooLarge
+	}
+
+	return data, resp.Header.Get("Content-Type"), nil
+}
+
+// Merge returns whether the pull request can be merged, and the merge checks
+// preventing it if not.
+func (a *API) Merge(ctx context.Context, proj, slug string, id int) (MergeStatus, error) {
+	resp, err := a.get(ctx, fmt.Sprintf("/projects/%s/repos/%s/pull-requests/%d/merge", proj, slug, id), nil)
+	if err != nil {
+		return MergeStatus{}, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return MergeStatus{}, fmt.Errorf("fetching merge status: %s", resp.Status)
+	}
+
+	var status MergeStatus
+	if err := json.NewDecoder(resp.Body).Decode(&status); err != nil {
+		return MergeStatus{}, err
+	}
+
+	return status, nil
+}
+
+// BuildStatuses returns the statuses of the builds of the commit.
+func (a *API) BuildStatuses(ctx context.Context, commit string) ([]BuildStatus, error) {
+	var statuses []BuildStatus
+	if err := a.valuesURL(ctx, a.rest("build-status/1.0")+"/commits/"+commit, nil, &statuses); err != nil {
+		return nil, err
+	}
+
+	return statuses, nil
+}
+
+// InsightReports returns the Code Insights reports on the commit.
+func (a *API) InsightReports(ctx context.Context, proj, slug, commit string) ([]InsightReport, error) {
+	var reports []InsightReport
+	if err := a.valuesURL(ctx, a.rest("insights/1.0")+fmt.Sprintf("/projects/%s/repos/%s/commits/%s/reports", proj, slug, commit), nil, &reports); err != nil {
+		return nil, err
+	}
+
+	return reports, nil
+}
+
+// InsightAnnotations returns the annotations of all the Code Insights
+// reports on the commit.
+func (a *API) InsightAnnotations(ctx context.Context, proj, slug, commit string) ([]InsightAnnotation, error) {
+	resp, err := a.getURL(ctx, a.rest("insights/1.0")+fmt.Sprintf("/projects/%s/repos/%s/commits/%s/annotations", proj, slug, commit), nil)
+	if err != nil {
+		return nil, err
+	}
 	defer resp.Body.Close()
 
-	return ioutil.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("fetching annotations: %s", resp.Status)
+	}
+
+	var annotations struct {
+		Annotations []InsightAnnotation `json:"annotations"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&annotations); err != nil {
+		return nil, err
+	}
+
+	return annotations.Annotations, nil
 }
@@ -6,15 +6,19 @@ package bitbucket
 
 import (
 	"encoding/json"
+	"strings"
 )
 
 type Response struct {
-	Size       int             `json:"size"`
-	Start      int             `json:"start"`
-	Limit      int             `json:"limit"`
-	IsLastPage bool            `json:"isLastPage"`
-	Errors     []Error         `json:"errors"`
-	Values     json.RawMessage `json:"values"`
+	Size       int  `json:"size"`
+	Start      int  `json:"start"`
+	Limit      int  `json:"limit"`
+	IsLastPage bool `json:"isLastPage"`
+	// NextPageStart is the start of the next page, unless this is the
+	// last one.
+	NextPageStart int             `json:"nextPageStart"`
+	Errors        []Error         `json:"errors"`
+	Values        json.RawMessage `json:"values"`
 }
 
 type Error struct {
@@ -117,15 +121,171 @@ type PullRequestActivity struct {
 
 	CommentAction string             `json:"commentAction"`
 	Comment       PullRequestComment `json:"comment"`
+	// CommentAnchor and Diff locate comments on a line of the diff.
+	CommentAnchor *CommentAnchor `json:"commentAnchor,omitempty"`
+	Diff          *Diff          `json:"diff,omitempty"`
+}
+
+type CommentAnchor struct {
+	FromHash string `json:"fromHash"`
+	ToHash   string `json:"toHash"`
+	Line     int    `json:"line"`
+	LineType string `json:"lineType"`
+	FileType string `json:"fileType"`
+	Path     string `json:"path"`
+	SrcPath  string `json:"srcPath"`
+	DiffType string `json:"diffType"`
+}
+
+type Diff struct {
+	Source      *Path      `json:"source"`
+	Destination *Path      `json:"destination"`
+	Hunks       []DiffHunk `json:"hunks"`
+	Truncated   bool       `json:"truncated"`
+}
+
+type DiffHunk struct {
+	SourceLine      int           `json:"sourceLine"`
+	SourceSpan      int           `json:"sourceSpan"`
+	DestinationLine int           `json:"destinationLine"`
+	DestinationSpan int           `json:"destinationSpan"`
+	Segments        []DiffSegment `json:"segments"`
+	Truncated       bool          `json:"truncated"`
+}
+
+type DiffSegment struct {
+	Type      string     `json:"type"`
+	Lines     []DiffLine `json:"lines"`
+	Truncated bool       `json:"truncated"`
+}
+
+type DiffLine struct {
+	Source      int    `json:"source"`
+	Destination int    `json:"destination"`
+	Line        string `json:"line"`
+	Truncated   bool   `json:"truncated"`
 }
 
 type PullRequestComment struct {
-	Author       User                   `json:"author"`
-	ID           int                    `json:"id"`
-	CreatedDated int64                  `json:"createdDate"`
-	UpdatedDate  int64                  `json:"updatedDate"`
-	Text         string                 `json:"text"`
-	HTML         string                 `json:"html"`
-	Comments     []PullRequestComment   `json:"comments"`
-	Properties   map[string]interface{} `json:"properties"`
+	Author      User                   `json:"author"`
+	ID          int                    `json:"id"`
+	Version     int                    `json:"version"`
+	CreatedDate int64                  `json:"createdDate"`
+	UpdatedDate int64                  `json:"updatedDate"`
+	Text        string                 `json:"text"`
+	HTML        string                 `json:"html"`
+	Comments    []PullRequestComment   `json:"comments"`
+	Properties  map[string]interface{} `json:"properties"`
+
+	// Severity is BLOCKER for comments that are tasks, whose State is OPEN
+	// or RESOLVED, since Bitbucket Server 7.
+	Severity     string `json:"severity,omitempty"`
+	State        string `json:"state,omitempty"`
+	Resolver     *User  `json:"resolver,omitempty"`
+	ResolvedDate int64  `json:"resolvedDate,omitempty"`
+	// Tasks are the tasks on the comment in earlier versions.
+	Tasks []Task `json:"tasks,omitempty"`
+}
+
+// Blocker reports whether the comment is a task that must be resolved.
+func (c PullRequestComment) Blocker() bool {
+	return c.Severity == "BLOCKER"
+}
+
+// Task is a task on a comment, before Bitbucket Server 7 made blocker
+// comments tasks.
+type Task struct {
+	ID          int    `json:"id"`
+	Author      User   `json:"author"`
+	Text        string `json:"text"`
+	State       string `json:"state"`
+	CreatedDate int64  `json:"createdDate"`
+}
+
+type MergeStatus struct {
+	CanMerge   bool        `json:"canMerge"`
+	Conflicted bool        `json:"conflicted"`
+	Outcome    string      `json:"outcome"`
+	Vetoes     []MergeVeto `json:"vetoes"`
+}
+
+// MergeVeto is a merge check preventing a pull request from being merged.
+type MergeVeto struct {
+	SummaryMessage  string `json:"summaryMessage"`
+	DetailedMessage string `json:"detailedMessage"`
+}
+
+type BuildStatus struct {
+	State       string `json:"state"`
+	Key         string `json:"key"`
+	Name        string `json:"name"`
+	URL         string `json:"url"`
+	Description string `json:"description"`
+	DateAdded   int64  `json:"dateAdded"`
+}
+
+type InsightReport struct {
+	Key     string `json:"key"`
+	Title   string `json:"title"`
+	Details string `json:"details"`
+	Result  string `json:"result"`
+	Link    string `json:"link"`
+}
+
+// InsightAnnotation marks a line of a file with a finding of a Code Insights
+// report. Line is zero for findings about the whole file.
+type InsightAnnotation struct {
+	ReportKey string `json:"reportKey"`
+	Path      string `json:"path"`
+	Line      int    `json:"line"`
+	Message   string `json:"message"`
+	Severity  string `json:"severity"`
+	Type      string `json:"type"`
+	Link      string `json:"link"`
+}
+
+type Change struct {
+	ContentID string `json:"contentId"`
+	Type      string `json:"type"`
+	NodeType  string `json:"nodeType"`
+	Path      Path   `json:"path"`
+	SrcPath   *Path  `json:"srcPath,omitempty"`
+}
+
+type Path struct {
+	Components []string `json:"components"`
+	Parent     string   `json:"parent"`
+	Name       string   `json:"name"`
+	Extension  string   `json:"extension"`
+	ToString   string   `json:"toString"`
+}
+
+type Label struct {
+	Name string `json:"name"`
+}
+
+type Commit struct {
+	ID                 string          `json:"id"`
+	DisplayID          string          `json:"displayId"`
+	Message            string          `json:"message"`
+	Author             User            `json:"author"`
+	AuthorTimestamp    int64           `json:"authorTimestamp"`
+	Committer          User            `json:"committer"`
+	CommitterTimestamp int64           `json:"committerTimestamp"`
+	Parents            []MinimalCommit `json:"parents"`
+}
+
+type MinimalCommit struct {
+	ID        string `json:"id"`
+	DisplayID string `json:"displayId"`
+}
+
+// Subject returns the first line of the commit message.
+func (c Commit) Subject() string {
+	subject := c.Message
+	if i := strings.IndexByte(subject, '\n'); i >= 0 {
+		subject = subject[:i]
+	}
+
+	return strings.TrimSpace(subject)
 }
@@ -4,6 +4,8 @@ import (
 	"context"
 	"database/sql"
 	"fmt"
+	"strconv"
+	"strings"
 )
 
 type DB struct {
@@ -56,3 +58,365 @@ VALUES (?, ?) ON CONFLICT(key) DO
 
 	return nil
 }
+
+// PullRequest is the delivery state of a pull request.
+type PullRequest struct {
+	Project      string
+	Repo         string
+	ID           int
+	LastActivity int
+	// State is the state the pull request was last synced in, empty for
+	// pull requests synced before it was recorded.
+	State string
+}
+
+func (db *DB) PullRequests(ctx context.Context) ([]PullRequest, error) {
+	rows, err := db.db.QueryContext(ctx, "SELECT key, last_activity, state FROM pulls ORDER BY key")
+	if err != nil {
+		return nil, fmt.Errorf("listing pull requests: %w", err)
+	}
+	defer rows.Close()
+
+	var pulls []PullRequest
+	for rows.Next() {
+		var (
+			key   string
+			state sql.NullString
+			pr    PullRequest
+		)
+
+		if err := rows.Scan(&key, &pr.LastActivity, &state); err != nil {
+			return nil, fmt.Errorf("listing pull requests: %w", err)
+		}
+		pr.State = state.String
+
+		parts := strings.Split(key, "/")
+		if len(parts) != 3 {
+			return nil, fmt.Errorf("listing pull requests: malformed key %q", key)
+		}
+
+		pr.Project, pr.Repo = parts[0], parts[1]
+		if pr.ID, err = strconv.Atoi(parts[2]); err != nil {
+			return nil, fmt.Errorf("listing pull requests: malformed key %q", key)
+		}
+
+		pulls = append(pulls, pr)
+	}
+
+	return pulls, rows.Err()
+}
+
+// SetState records the state the pull request was synced in.
+func (db *DB) SetState(ctx context.Context, project, repo string, id int, state string) error {
+	_, err := db.db.ExecContext(ctx, "UPDATE pulls SET state = ? WHERE key = ?", state, prKey(project, repo, id))
+	if err != nil {
+		return fmt.Errorf("setting pull request state: %w", err)
+	}
+
+	return nil
+}
+
+// Message records where a message was delivered.
+type Message struct {
+	MessageID   string
+	Project     string
+	Repo        string
+	PullRequest int
+	Folder      string
+	Filename    string
+	// Dropped is set for messages a rule dropped, which have no folder or
+	// filename.
+	Dropped bool
+}
+
+func (db *DB) RecordMessage(ctx context.Context, m Message) error {
+	_, err := db.db.ExecContext(ctx, `
+INSERT INTO messages (message_id, project, repo, pull_request, folder, filename, dropped)
+VALUES (?, ?, ?, ?, ?, ?, ?) ON CONFLICT(message_id) DO
+  UPDATE SET folder = excluded.folder, filename = excluded.filename, dropped = excluded.dropped
+`,
+		m.MessageID, m.Project, m.Repo, m.PullRequest, m.Folder, m.Filename, m.Dropped,
+	)
+
+	if err != nil {
+		return fmt.Errorf("recording message: %w", err)
+	}
+
+	return nil
+}
+
+func (db *DB) HasMessage(ctx context.Context, messageID string) (bool, error) {
+	var exists bool
+
+	row := db.db.QueryRowContext(ctx, "SELECT EXISTS(SELECT message_id FROM messages WHERE message_id = ?)", messageID)
+	if err := row.Scan(&exists); err != nil {
+		return false, fmt.Errorf("determining if message exists: %w", err)
+	}
+
+	return exists, nil
+}
+
+func (db *DB) Messages(ctx context.Context) ([]Message, error) {
+	rows, err := db.db.QueryContext(ctx, `
+SELECT message_id, project, repo, pull_request, folder, filename, dropped
+FROM messages ORDER BY message_id
+`)
+	if err != nil {
+		return nil, fmt.Errorf("listing messages: %w", err)
+	}
+	defer rows.Close()
+
+	var messages []Message
+	for rows.Next() {
+		var m Message
+		if err := rows.Scan(&m.MessageID, &m.Project, &m.Repo, &m.PullRequest, &m.Folder, &m.Filename, &m.Dropped); err != nil {
+			return nil, fmt.Errorf("listing messages: %w", err)
+		}
+
+		messages = append(messages, m)
+	}
+
+	return messages, rows.Err()
+}
+
+// RenameMessageDomain moves the recorded messages with Message-Ids in the old
+// domain to the new one, replacing any already recorded in the new domain.
+func (db *DB) RenameMessageDomain(ctx context.Context, old, new string) (int64, error) {
+	res, err := db.db.ExecContext(ctx, `
+UPDATE OR REPLACE messages
+SET message_id = substr(message_id, 1, length(message_id) - length(?1)) || ?2
+WHERE substr(message_id, length(message_id) - length(?1) + 1) = ?1
+`,
+		"@"+old, "@"+new,
+	)
+	if err != nil {
+		return 0, fmt.Errorf("renaming message domain: %w", err)
+	}
+
+	return res.RowsAffected()
+}
+
+// Comment is a comment as it was last seen, to find comments that were
+// since edited or deleted.
+type Comment struct {
+	ID int
+	// Parent is the comment replied to, or zero.
+	Parent  int
+	Version int
+	Hash    string
+	// Edits counts the edits delivered, and Tasks the changes to the state
+	// of its tasks.
+	Edits   int
+	Tasks   int
+	Deleted bool
+	// Data is the comment, encoded by the caller.
+	Data []byte
+}
+
+func (db *DB) Comments(ctx context.Context, project, repo string, id int) ([]Comment, error) {
+	rows, err := db.db.QueryContext(ctx, `
+SELECT comment_id, parent_id, version, hash, edits, tasks, deleted, comment
+FROM comments WHERE pull = ? ORDER BY comment_id
+`, prKey(project, repo, id))
+	if err != nil {
+		return nil, fmt.Errorf("listing comments: %w", err)
+	}
+	defer rows.Close()
+
+	var comments []Comment
+	for rows.Next() {
+		var c Comment
+		if err := rows.Scan(&c.ID, &c.Parent, &c.Version, &c.Hash, &c.Edits, &c.Tasks, &c.Deleted, &c.Data); err != nil {
+			return nil, fmt.Errorf("listing comments: %w", err)
+		}
+
+		comments = append(comments, c)
+	}
+
+	return comments, rows.Err()
+}
+
+func (db *DB) UpsertComment(ctx context.Context, project, repo string, id int, c Comment) error {
+	_, err := db.db.ExecContext(ctx, `
+INSERT INTO comments (pull, comment_id, parent_id, version, hash, edits, tasks, deleted, comment)
+VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?) ON CONFLICT(pull, comment_id) DO
+  UPDATE SET parent_id = excluded.parent_id, version = excluded.version, hash = excluded.hash,
+    edits = excluded.edits, tasks = excluded.tasks, deleted = excluded.deleted, comment = excluded.comment
+`,
+		prKey(project, repo, id), c.ID, c.Parent, c.Version, c.Hash, c.Edits, c.Tasks, c.Deleted, c.Data,
+	)
+
+	if err != nil {
+		return fmt.Errorf("upserting comment: %w", err)
+	}
+
+	return nil
+}
+
+// Build is the state of a build of a pull request as it was last seen, to
+// deliver its changes.
+type Build struct {
+	Key    string
+	Commit string
+	State  string
+	// Seq numbers the build messages of the pull request.
+	Seq int
+}
+
+func (db *DB) Builds(ctx context.Context, project, repo string, id int) ([]Build, error) {
+	rows, err := db.db.QueryContext(ctx, `
+SELECT key, commit_id, state, seq FROM builds WHERE pull = ? ORDER BY seq
+`, prKey(project, repo, id))
+	if err != nil {
+		return nil, fmt.Errorf("listing builds: %w", err)
+	}
+	defer rows.Close()
+
+	var builds []Build
+	for rows.Next() {
+		var b Build
+		if err := rows.Scan(&b.Key, &b.Commit, &b.State, &b.Seq); err != nil {
+			return nil, fmt.Errorf("listing builds: %w", err)
+		}
+
+		builds = append(builds, b)
+	}
+
+	return builds, rows.Err()
+}
+
+func (db *DB) UpsertBuild(ctx context.Context, project, repo string, id int, b Build) error {
+	_, err := db.db.ExecContext(ctx, `
+INSERT INTO builds (pull, key, commit_id, state, seq) VALUES (?, ?, ?, ?, ?)
+ON CONFLICT(pull, key) DO
+  UPDATE SET commit_id = excluded.commit_id, state = excluded.state, seq = excluded.seq
+`,
+		prKey(project, repo, id), b.Key, b.Commit, b.State, b.Seq,
+	)
+
+	if err != nil {
+		return fmt.Errorf("upserting build: %w", err)
+	}
+
+	return nil
+}
+
+// RootVersion returns the version of the pull request the root message was
+// written from, if it was recorded.
+func (db *DB) RootVersion(ctx context.Context, project, repo string, id int) (int, bool, error) {
+	var version sql.NullInt64
+
+	row := db.db.QueryRowContext(ctx, "SELECT version FROM pulls WHERE key = ?", prKey(project, repo, id))
+	if err := row.Scan(&version); err != nil {
+		return 0, false, fmt.Errorf("determining root version: %w", err)
+	}
+
+	return int(version.Int64), version.Valid, nil
+}
+
+func (db *DB) SetRootVersion(ctx context.Context, project, repo string, id, version int) error {
+	_, err := db.db.ExecContext(ctx, "UPDATE pulls SET version = ? WHERE key = ?", version, prKey(project, repo, id))
+	if err != nil {
+		return fmt.Errorf("setting root version: %w", err)
+	}
+
+	return nil
+}
+
+// Message returns where the message was delivered, if it was recorded.
+func (db *DB) Message(ctx context.Context, messageID string) (Message, bool, error) {
+	m := Message{MessageID: messageID}
+
+	row := db.db.QueryRowContext(ctx, `
+SELECT project, repo, pull_request, folder, filename, dropped
+FROM messages WHERE message_id = ?
+`, messageID)
+	switch err := row.Scan(&m.Project, &m.Repo, &m.PullRequest, &m.Folder, &m.Filename, &m.Dropped); {
+	case err == sql.ErrNoRows:
+		return Message{}, false, nil
+	case err != nil:
+		return Message{}, false, fmt.Errorf("finding message: %w", err)
+	}
+
+	return m, true, nil
+}
+
+// Description is the title and description of a pull request as they were
+// last seen, in a version of the pull request.
+type Description struct {
+	Version     int
+	Title       string
+	Description string
+}
+
+// LastDescription returns the title and description of the pull request as
+// they were last seen, if they were recorded.
+func (db *DB) LastDescription(ctx context.Context, project, repo string, id int) (Description, bool, error) {
+	var (
+		version            sql.NullInt64
+		title, description sql.NullString
+	)
+
+	row := db.db.QueryRowContext(ctx, "SELECT seen_version, title, description FROM pulls WHERE key = ?", prKey(project, repo, id))
+	if err := row.Scan(&version, &title, &description); err != nil {
+		return Description{}, false, fmt.Errorf("determining last description: %w", err)
+	}
+
+	return Description{
+		Version:     int(version.Int64),
+		Title:       title.String,
+		Description: description.String,
+	}, version.Valid, nil
+}
+
+func (db *DB) SetDescription(ctx context.Context, project, repo string, id int, d Description) error {
+	_, err := db.db.ExecContext(ctx, "UPDATE pulls SET seen_version = ?, title = ?, description = ? WHERE key = ?",
+		d.Version, d.Title, d.Description, prKey(project, repo, id),
+	)
+	if err != nil {
+		return fmt.Errorf("setting description: %w", err)
+	}
+
+	return nil
+}
+
+// User is a user as they were last looked up, with an empty name and
+// address if they were not found.
+type User struct {
+	Slug  string
+	Name  string
+	Email string
+	// Fetched is when the user was looked up, in Unix time.
+	Fetched int64
+}
+
+// User returns the user with the slug, if they were looked up.
+func (db *DB) User(ctx context.Context, slug string) (User, bool, error) {
+	u := User{Slug: slug}
+
+	row := db.db.QueryRowContext(ctx, "SELECT name, email, fetched FROM users WHERE slug = ?", slug)
+	switch err := row.Scan(&u.Name, &u.Email, &u.Fetched); {
+	case err == sql.ErrNoRows:
+		return User{}, false, nil
+	case err != nil:
+		return User{}, false, fmt.Errorf("finding user: %w", err)
+	}
+
+	return u, true, nil
+}
+
+func (db *DB) UpsertUser(ctx context.Context, u User) error {
+	_, err := db.db.ExecContext(ctx, `
+INSERT INTO users (slug, name, email, fetched) VALUES (?, ?, ?, ?)
+ON CONFLICT(slug) DO
+  UPDATE SET name = excluded.name, email = excluded.email, fetched = excluded.fetched
+`,
+		u.Slug, u.Name, u.Email, u.Fetched,
+	)
+
+	if err != nil {
+		return fmt.Errorf("upserting user: %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,42 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package diff
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Position tracks where in the new version of its file each line of a diff
+// is, a line at a time.
+type Position struct {
+	c    counter
+	next int
+}
+
+// Line advances past a line of the diff, returning the path of its file and
+// its line number in the new version, or zero if it is not in it.
+func (p *Position) Line(line string) (string, int) {
+	p.c.line(line)
+	if len(p.c.stats) == 0 || !p.c.inHunk {
+		return "", 0
+	}
+
+	path := p.c.stats[len(p.c.stats)-1].Path
+	line = strings.TrimRight(line, "\r\n")
+
+	switch {
+	case strings.HasPrefix(line, "@@"):
+		var old string
+		fmt.Sscanf(line, "@@ -%s +%d", &old, &p.next)
+		return path, 0
+	case strings.HasPrefix(line, "-"), strings.HasPrefix(line, `\`):
+		return path, 0
+	}
+
+	n := p.next
+	p.next++
+	return path, n
+}
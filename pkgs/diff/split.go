@@ -0,0 +1,65 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package diff
+
+import (
+	"bufio"
+	"io"
+)
+
+// File is the position of the diff of a single file in a copy of the diff.
+type File struct {
+	FileStat
+	Offset int64
+	Length int64
+	Lines  int
+}
+
+// Copy copies the diff from r to w, returning the position of each file in
+// the copy. Anything before the first file, such as a commit message, is
+// copied but not part of any file.
+func Copy(w io.Writer, r io.Reader) ([]File, error) {
+	var (
+		files  []File
+		offset int64
+		c      counter
+		br     = bufio.NewReader(r)
+	)
+
+	for {
+		line, err := br.ReadString('\n')
+		if err != nil && err != io.EOF {
+			return nil, err
+		}
+		if line == "" {
+			break
+		}
+
+		if c.line(line) {
+			files = append(files, File{Offset: offset})
+		}
+		if len(files) > 0 {
+			f := &files[len(files)-1]
+			f.Length += int64(len(line))
+			f.Lines++
+		}
+
+		n, werr := io.WriteString(w, line)
+		offset += int64(n)
+		if werr != nil {
+			return nil, werr
+		}
+
+		if err == io.EOF {
+			break
+		}
+	}
+
+	for i, s := range c.stats {
+		files[i].FileStat = s
+	}
+
+	return files, nil
+}
@@ -0,0 +1,194 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+// Package diff summarizes unified diffs in the format produced by git and
+// Bitbucket, and compares texts.
+package diff
+
+import (
+	"fmt"
+	"strings"
+)
+
+// FileStat counts the lines changed in a file.
+type FileStat struct {
+	// Path is the path of the file, or its former path if it was deleted.
+	Path string
+	// OldPath is the former path of a renamed file.
+	OldPath string
+	Added   int
+	Deleted int
+	Binary  bool
+}
+
+// Name returns the path of the file, or "old => new" for renames.
+func (s FileStat) Name() string {
+	if s.OldPath != "" {
+		return s.OldPath + " => " + s.Path
+	}
+
+	return s.Path
+}
+
+// counter counts the lines changed in each file of a diff, a line at a time.
+type counter struct {
+	stats  []FileStat
+	inHunk bool
+	from   string
+}
+
+// line counts a line of the diff, reporting whether it starts a new file.
+func (c *counter) line(line string) bool {
+	line = strings.TrimRight(line, "\r\n")
+
+	if strings.HasPrefix(line, "diff ") {
+		c.stats = append(c.stats, FileStat{Path: gitPath(line)})
+		c.inHunk = false
+		c.from = ""
+		return true
+	}
+
+	if len(c.stats) == 0 {
+		return false
+	}
+	file := &c.stats[len(c.stats)-1]
+
+	switch {
+	case strings.HasPrefix(line, "@@"):
+		c.inHunk = true
+	case c.inHunk && strings.HasPrefix(line, "+"):
+		file.Added++
+	case c.inHunk && strings.HasPrefix(line, "-"):
+		file.Deleted++
+	case c.inHunk:
+	case strings.HasPrefix(line, "--- "):
+		c.from = trimPrefix(line[4:])
+	case strings.HasPrefix(line, "+++ "):
+		if to := trimPrefix(line[4:]); to != "/dev/null" {
+			file.Path = to
+		} else if c.from != "" {
+			file.Path = c.from
+		}
+	case strings.HasPrefix(line, "rename from "):
+		file.OldPath = line[len("rename from "):]
+	case strings.HasPrefix(line, "rename to "):
+		file.Path = line[len("rename to "):]
+	case strings.HasPrefix(line, "Binary files "):
+		file.Binary = true
+	}
+
+	return false
+}
+
+// gitPath returns the destination path of a "diff --git a/x b/x" line.
+func gitPath(line string) string {
+	fields := strings.Fields(line)
+	if len(fields) == 0 {
+		return ""
+	}
+
+	return trimPrefix(fields[len(fields)-1])
+}
+
+// trimPrefix removes the source or destination prefix of a path, either the
+// "a/" and "b/" used by git or the "src://" and "dst://" used by Bitbucket.
+func trimPrefix(path string) string {
+	if i := strings.IndexByte(path, '\t'); i >= 0 {
+		path = path[:i]
+	}
+
+	for _, prefix := range []string{"a/", "b/", "src://", "dst://"} {
+		if strings.HasPrefix(path, prefix) {
+			return path[len(prefix):]
+		}
+	}
+
+	return path
+}
+
+// Format formats the stats like "git diff --stat", with a histogram of the
+// changes scaled to fit within width columns.
+func Format(stats []FileStat, width int) string {
+	if len(stats) == 0 {
+		return ""
+	}
+
+	var (
+		nameWidth, maxChanges int
+		added, deleted        int
+		binary                bool
+	)
+	for _, s := range stats {
+		binary = binary || s.Binary
+		if len(s.Name()) > nameWidth {
+			nameWidth = len(s.Name())
+		}
+		if c := s.Added + s.Deleted; c > maxChanges {
+			maxChanges = c
+		}
+		added += s.Added
+		deleted += s.Deleted
+	}
+
+	countWidth := len(fmt.Sprint(maxChanges))
+	if binary && countWidth < 3 {
+		// Wide enough for "Bin".
+		countWidth = 3
+	}
+
+	// " path | count graph"
+	graphWidth := width - nameWidth - countWidth - 5
+	if graphWidth < 10 {
+		graphWidth = 10
+	}
+
+	var b strings.Builder
+	for _, s := range stats {
+		if s.Binary {
+			fmt.Fprintf(&b, " %-*s | %*s\n", nameWidth, s.Name(), countWidth, "Bin")
+			continue
+		}
+
+		plus, minus := s.Added, s.Deleted
+		if maxChanges > graphWidth {
+			plus, minus = scale(plus, graphWidth, maxChanges), scale(minus, graphWidth, maxChanges)
+		}
+
+		line := fmt.Sprintf(" %-*s | %*d %s%s", nameWidth, s.Name(), countWidth, s.Added+s.Deleted,
+			strings.Repeat("+", plus), strings.Repeat("-", minus))
+
+		// Files without changed lines, such as mode changes, have no
+		// histogram, which would otherwise leave a trailing space.
+		b.WriteString(strings.TrimRight(line, " ") + "\n")
+	}
+
+	fmt.Fprintf(&b, " %d %s changed", len(stats), plural(len(stats), "file", "files"))
+	if added > 0 {
+		fmt.Fprintf(&b, ", %d %s(+)", added, plural(added, "insertion", "insertions"))
+	}
+	if deleted > 0 {
+		fmt.Fprintf(&b, ", %d %s(-)", deleted, plural(deleted, "deletion", "deletions"))
+	}
+	b.WriteString("\n")
+
+	return b.String()
+}
+
+// scale scales n changes to the width of the histogram, showing at least one
+// character for any change, as git does.
+func scale(n, width, max int) int {
+	if n == 0 {
+		return 0
+	}
+
+	return 1 + n*(width-1)/max
+}
+
+func plural(n int, one, many string) string {
+	if n == 1 {
+		return one
+	}
+
+	return many
+}
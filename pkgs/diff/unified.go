@@ -0,0 +1,108 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package diff
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Unified compares two texts a line at a time, returning a unified diff
+// between the from and to names with context lines around each change, or
+// nothing if the texts are the same.
+func Unified(from, to, old, new string, context int) string {
+	edits := script(lines(old), lines(new))
+
+	// Each hunk is the range of edits around changes less than two
+	// contexts apart.
+	var hunks [][2]int
+	for i, e := range edits {
+		if e.Op == Equal {
+			continue
+		}
+
+		start, end := i-context, i+1+context
+		if start < 0 {
+			start = 0
+		}
+		if end > len(edits) {
+			end = len(edits)
+		}
+
+		if n := len(hunks); n > 0 && start <= hunks[n-1][1] {
+			hunks[n-1][1] = end
+			continue
+		}
+		hunks = append(hunks, [2]int{start, end})
+	}
+
+	if len(hunks) == 0 {
+		return ""
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "--- %s\n+++ %s\n", from, to)
+
+	oldLine, newLine, next := 0, 0, 0
+	for _, h := range hunks {
+		for ; next < h[0]; next++ {
+			oldLine++
+			newLine++
+		}
+
+		var oldCount, newCount int
+		for _, e := range edits[h[0]:h[1]] {
+			if e.Op != Insert {
+				oldCount++
+			}
+			if e.Op != Delete {
+				newCount++
+			}
+		}
+
+		fmt.Fprintf(&b, "@@ -%s +%s @@\n", hunkRange(oldLine, oldCount), hunkRange(newLine, newCount))
+
+		for _, e := range edits[h[0]:h[1]] {
+			switch e.Op {
+			case Delete:
+				b.WriteString("-" + e.Text + "\n")
+				oldLine++
+			case Insert:
+				b.WriteString("+" + e.Text + "\n")
+				newLine++
+			default:
+				b.WriteString(" " + e.Text + "\n")
+				oldLine++
+				newLine++
+			}
+		}
+		next = h[1]
+	}
+
+	return b.String()
+}
+
+// hunkRange formats the range of a hunk that starts after the given line,
+// as git does.
+func hunkRange(line, count int) string {
+	switch count {
+	case 0:
+		return fmt.Sprintf("%d,0", line)
+	case 1:
+		return fmt.Sprint(line + 1)
+	}
+
+	return fmt.Sprintf("%d,%d", line+1, count)
+}
+
+// lines splits text into lines without their line endings.
+func lines(text string) []string {
+	text = strings.TrimSuffix(strings.ReplaceAll(text, "\r\n", "\n"), "\n")
+	if text == "" {
+		return nil
+	}
+
+	return strings.Split(text, "\n")
+}
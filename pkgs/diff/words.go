@@ -0,0 +1,160 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package diff
+
+import (
+	"strings"
+	"unicode"
+)
+
+// Op is how a chunk of text changed.
+type Op int
+
+const (
+	Equal Op = iota
+	Delete
+	Insert
+)
+
+// Chunk is a run of text that is unchanged, deleted or inserted.
+type Chunk struct {
+	Op   Op
+	Text string
+}
+
+// maxCells bounds the table used to compare texts. Longer texts are shown
+// as replaced entirely.
+const maxCells = 1 << 22
+
+// Words compares two texts a word at a time, keeping the whitespace between
+// words.
+func Words(old, new string) []Chunk {
+	return compare(words(old), words(new))
+}
+
+// words splits text into runs of whitespace and runs of anything else.
+func words(text string) []string {
+	var (
+		tokens []string
+		start  int
+		space  bool
+	)
+
+	for i, r := range text {
+		s := unicode.IsSpace(r)
+		if i > start && s != space {
+			tokens = append(tokens, text[start:i])
+			start = i
+		}
+		space = s
+	}
+	if start < len(text) {
+		tokens = append(tokens, text[start:])
+	}
+
+	return tokens
+}
+
+// compare returns the chunks turning the old tokens into the new ones.
+func compare(old, new []string) []Chunk {
+	var chunks []Chunk
+	for _, e := range script(old, new) {
+		if n := len(chunks); n > 0 && chunks[n-1].Op == e.Op {
+			chunks[n-1].Text += e.Text
+			continue
+		}
+		chunks = append(chunks, e)
+	}
+
+	return chunks
+}
+
+// script returns a chunk for each token, turning the old tokens into the
+// new ones, from their longest common subsequence.
+func script(old, new []string) []Chunk {
+	// Unchanged tokens at either end need not be compared.
+	prefix := 0
+	for prefix < len(old) && prefix < len(new) && old[prefix] == new[prefix] {
+		prefix++
+	}
+	suffix := 0
+	for suffix < len(old)-prefix && suffix < len(new)-prefix && old[len(old)-1-suffix] == new[len(new)-1-suffix] {
+		suffix++
+	}
+
+	edits := make([]Chunk, 0, len(old)+len(new)-prefix-suffix)
+	for _, token := range old[:prefix] {
+		edits = append(edits, Chunk{Equal, token})
+	}
+
+	a, b := old[prefix:len(old)-suffix], new[prefix:len(new)-suffix]
+	if len(a)*len(b) > maxCells {
+		for _, token := range a {
+			edits = append(edits, Chunk{Delete, token})
+		}
+		for _, token := range b {
+			edits = append(edits, Chunk{Insert, token})
+		}
+	} else {
+		// lcs[i][j] is the length of the longest common subsequence of
+		// a[i:] and b[j:].
+		lcs := make([][]int32, len(a)+1)
+		for i := range lcs {
+			lcs[i] = make([]int32, len(b)+1)
+		}
+		for i := len(a) - 1; i >= 0; i-- {
+			for j := len(b) - 1; j >= 0; j-- {
+				switch {
+				case a[i] == b[j]:
+					lcs[i][j] = lcs[i+1][j+1] + 1
+				case lcs[i+1][j] >= lcs[i][j+1]:
+					lcs[i][j] = lcs[i+1][j]
+				default:
+					lcs[i][j] = lcs[i][j+1]
+				}
+			}
+		}
+
+		i, j := 0, 0
+		for i < len(a) || j < len(b) {
+			switch {
+			case i < len(a) && j < len(b) && a[i] == b[j]:
+				edits = append(edits, Chunk{Equal, a[i]})
+				i++
+				j++
+			case j == len(b) || (i < len(a) && lcs[i+1][j] >= lcs[i][j+1]):
+				edits = append(edits, Chunk{Delete, a[i]})
+				i++
+			default:
+				edits = append(edits, Chunk{Insert, b[j]})
+				j++
+			}
+		}
+	}
+
+	for _, token := range old[len(old)-suffix:] {
+		edits = append(edits, Chunk{Equal, token})
+	}
+
+	return edits
+}
+
+// FormatWords formats the chunks like wdiff, with deleted text in [-...-]
+// and inserted text in {+...+}.
+func FormatWords(chunks []Chunk) string {
+	var b strings.Builder
+	for _, c := range chunks {
+		switch c.Op {
+		case Delete:
+			b.WriteString("[-" + c.Text + "-]")
+		case Insert:
+			b.WriteString("{+" + c.Text + "+}")
+		default:
+			b.WriteString(c.Text)
+		}
+	}
+
+	return b.String()
+}
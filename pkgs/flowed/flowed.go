@@ -0,0 +1,177 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+// Package flowed writes text/plain bodies with format=flowed, as described by
+// RFC 3676.
+//
+// Prose is wrapped with soft line breaks, a trailing space, so clients that
+// support flowed text can reflow it to fit their display, while fixed lines
+// such as diffs are written unchanged apart from space-stuffing. Lines
+// longer than the 998 octets allowed by RFC 5322 are broken with soft line
+// breaks too.
+package flowed
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"unicode/utf8"
+)
+
+const signature = "-- "
+
+// maxLine is the longest line allowed by RFC 5322, in octets without the
+// line break.
+const maxLine = 998
+
+// Fixed marks a line of prose given to WriteFlowed that is written as a
+// fixed line, such as a line of code or of a table, which must not be
+// wrapped. The mark itself is never written.
+const Fixed = "\x00"
+
+type Writer struct {
+	w     io.Writer
+	width int
+}
+
+// NewWriter returns a Writer that wraps prose at width characters.
+func NewWriter(w io.Writer, width int) *Writer {
+	return &Writer{w: w, width: width}
+}
+
+// WriteFlowed writes prose. Every line of text is a paragraph, which is
+// wrapped with soft line breaks, unless it is marked Fixed. Lines starting
+// with ">" are written as quotes of the corresponding depth. As with
+// WriteFixed, a final line break ends the last line.
+func (fw *Writer) WriteFlowed(text string) error {
+	text = strings.TrimSuffix(strings.ReplaceAll(text, "\r\n", "\n"), "\n")
+	for _, line := range strings.Split(text, "\n") {
+		fixed := strings.Contains(line, Fixed)
+		line = strings.ReplaceAll(line, Fixed, "")
+
+		depth := 0
+		for depth < len(line) && line[depth] == '>' {
+			depth++
+		}
+
+		quote := strings.Repeat(">", depth)
+		content := strings.TrimRight(line[depth:], " ")
+		if depth > 0 {
+			content = strings.TrimPrefix(content, " ")
+		}
+
+		// Leave room for the quote and space-stuffing.
+		limit := maxLine - depth - 1
+
+		width := fw.width
+		switch {
+		case fixed:
+			width = 0
+		case depth > 0:
+			width -= depth + 1
+		}
+
+		for _, l := range wrap(content, width, limit) {
+			// Empty quoted lines are not stuffed, which would leave a
+			// trailing space and make them flowed.
+			if _, err := io.WriteString(fw.w, quote+stuff(l, depth > 0 && l != "")+"\n"); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// WriteFixed writes text as fixed lines, which are only wrapped when longer
+// than the line length limit. Lines ending in a space other than the
+// signature separator would be read as flowed, so callers should check
+// Fixable first.
+func (fw *Writer) WriteFixed(text string) error {
+	text = strings.TrimSuffix(strings.ReplaceAll(text, Fixed, ""), "\n")
+	for _, line := range strings.Split(text, "\n") {
+		for _, l := range wrap(line, 0, maxLine-1) {
+			if _, err := io.WriteString(fw.w, stuff(l, false)+"\n"); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// Fixable reports whether text can be written as fixed lines, which is
+// when no line ends in a space, except for the signature separator.
+func Fixable(text []byte) bool {
+	for _, line := range bytes.Split(text, []byte("\n")) {
+		line = bytes.TrimSuffix(line, []byte("\r"))
+		if bytes.HasSuffix(line, []byte(" ")) && string(line) != signature {
+			return false
+		}
+	}
+
+	return true
+}
+
+// stuff space-stuffs a line, so that a leading space, ">" or "From " are
+// not mistaken for stuffing, quotes or an mbox separator. Quoted lines
+// are always stuffed, to separate the quote from its content.
+func stuff(line string, quoted bool) string {
+	if quoted || strings.HasPrefix(line, " ") || strings.HasPrefix(line, ">") || strings.HasPrefix(line, "From ") {
+		return " " + line
+	}
+
+	return line
+}
+
+// wrap breaks a paragraph into lines of at most width characters where
+// possible, leaving a trailing space on every line but the last. A width of
+// zero does not wrap. Lines are never longer than limit octets: words longer
+// than that are broken, which adds a space where the line is joined again.
+func wrap(paragraph string, width, limit int) []string {
+	var lines []string
+	for {
+		cut := len(paragraph)
+		if width > 0 && utf8.RuneCountInString(paragraph) > width {
+			cut = 0
+			for n := 0; n < width; n++ {
+				_, size := utf8.DecodeRuneInString(paragraph[cut:])
+				cut += size
+			}
+		}
+		if cut > limit {
+			cut = limit
+		}
+		if cut == len(paragraph) {
+			break
+		}
+
+		i := strings.LastIndexByte(paragraph[:cut], ' ')
+		if i <= 0 {
+			// Words longer than the width are kept whole, up to the
+			// limit.
+			i = strings.IndexByte(paragraph[cut:], ' ')
+			switch {
+			case i >= 0 && cut+i < limit:
+				i += cut
+			case len(paragraph) <= limit:
+				return append(lines, paragraph)
+			default:
+				n := limit - 1
+				for n > 0 && !utf8.RuneStart(paragraph[n]) {
+					n--
+				}
+
+				lines = append(lines, paragraph[:n]+" ")
+				paragraph = paragraph[n:]
+				continue
+			}
+		}
+
+		lines = append(lines, paragraph[:i+1])
+		paragraph = paragraph[i+1:]
+	}
+
+	return append(lines, paragraph)
+}
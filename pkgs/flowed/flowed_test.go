@@ -0,0 +1,207 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package flowed
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestWriteFlowed(t *testing.T) {
+	tests := []struct {
+		name string
+		text string
+		want string
+	}{
+		{
+			name: "short",
+			text: "Looks good.",
+			want: "Looks good.\n",
+		},
+		{
+			name: "soft breaks",
+			text: "The quick brown fox jumps over the lazy dog.",
+			want: "The quick brown fox \njumps over the lazy \ndog.\n",
+		},
+		{
+			name: "paragraphs",
+			text: "First paragraph here.\n\nSecond.",
+			want: "First paragraph \nhere.\n\nSecond.\n",
+		},
+		{
+			name: "trailing spaces",
+			text: "Trailing spaces   \nare removed  ",
+			want: "Trailing spaces\nare removed\n",
+		},
+		{
+			name: "long word",
+			text: "see https://bitbucket.example.com/projects/FOO now",
+			want: "see \nhttps://bitbucket.example.com/projects/FOO \nnow\n",
+		},
+		{
+			name: "long first word",
+			text: "https://bitbucket.example.com/projects/FOO",
+			want: "https://bitbucket.example.com/projects/FOO\n",
+		},
+		{
+			name: "leading space",
+			text: " indented",
+			want: "  indented\n",
+		},
+		{
+			name: "from",
+			text: "From here on it works.",
+			want: " From here on it \nworks.\n",
+		},
+		{
+			name: "quotes",
+			text: "> quoted text that is long enough\n>> nested\n>\nreply",
+			want: "> quoted text that \n> is long enough\n>> nested\n>\nreply\n",
+		},
+		{
+			name: "fixed",
+			text: Fixed + "    if frob := frobnicate(x); frob > 0 {",
+			want: "     if frob := frobnicate(x); frob > 0 {\n",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var b strings.Builder
+			if err := NewWriter(&b, 20).WriteFlowed(tt.text); err != nil {
+				t.Fatal(err)
+			}
+
+			if got := b.String(); got != tt.want {
+				t.Errorf("WriteFlowed(%q) = %q, want %q", tt.text, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestWriteFixed(t *testing.T) {
+	tests := []struct {
+		name string
+		text string
+		want string
+	}{
+		{
+			name: "unwrapped",
+			text: "diff --git a/main.go b/main.go\n@@ -1 +1 @@\n-old\n+new\n",
+			want: "diff --git a/main.go b/main.go\n@@ -1 +1 @@\n-old\n+new\n",
+		},
+		{
+			name: "stuffed",
+			text: " context\n>>> not a quote\nFrom the diff",
+			want: "  context\n >>> not a quote\n From the diff\n",
+		},
+		{
+			name: "mark",
+			text: Fixed + "code",
+			want: "code\n",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var b strings.Builder
+			if err := NewWriter(&b, 20).WriteFixed(tt.text); err != nil {
+				t.Fatal(err)
+			}
+
+			if got := b.String(); got != tt.want {
+				t.Errorf("WriteFixed(%q) = %q, want %q", tt.text, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLineLimit(t *testing.T) {
+	var (
+		word  = strings.Repeat("x", 1500)
+		runes = strings.Repeat("é", 600)
+		words = strings.TrimSpace(strings.Repeat("frob ", 300))
+	)
+
+	tests := []struct {
+		name  string
+		write func(*Writer, string) error
+		text  string
+	}{
+		{"flowed word", (*Writer).WriteFlowed, word},
+		{"flowed runes", (*Writer).WriteFlowed, runes},
+		{"quoted word", (*Writer).WriteFlowed, ">>> " + word},
+		{"fixed word", (*Writer).WriteFixed, word},
+		{"fixed stuffed word", (*Writer).WriteFixed, " " + word},
+		{"fixed words", (*Writer).WriteFixed, words},
+		{"fixed mark", (*Writer).WriteFlowed, Fixed + words},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var b strings.Builder
+			if err := tt.write(NewWriter(&b, 72), tt.text); err != nil {
+				t.Fatal(err)
+			}
+
+			lines := strings.Split(strings.TrimSuffix(b.String(), "\n"), "\n")
+			if len(lines) < 2 {
+				t.Errorf("got %d lines, want the text broken", len(lines))
+			}
+			for i, l := range lines {
+				if len(l) > maxLine {
+					t.Errorf("line %d is %d octets long", i, len(l))
+				}
+			}
+			if strings.HasPrefix(tt.text, " ") && !strings.HasPrefix(lines[0], "  ") {
+				t.Errorf("first line %.10q, want it stuffed", lines[0])
+			}
+			if last := lines[len(lines)-1]; strings.HasSuffix(last, " ") {
+				t.Errorf("last line %.10q ends in a soft break", last)
+			}
+		})
+	}
+}
+
+func TestLineLimitRejoins(t *testing.T) {
+	words := strings.TrimSpace(strings.Repeat("frob  nicate ", 100))
+
+	var b strings.Builder
+	if err := NewWriter(&b, 0).WriteFixed(words); err != nil {
+		t.Fatal(err)
+	}
+
+	// Soft line breaks are joined again by removing the line break, and
+	// any space-stuffing.
+	var joined strings.Builder
+	for _, l := range strings.Split(strings.TrimSuffix(b.String(), "\n"), "\n") {
+		joined.WriteString(strings.TrimPrefix(l, " "))
+	}
+	if got := joined.String(); got != words {
+		t.Errorf("joined lines = %.40q, want %.40q", got, words)
+	}
+}
+
+func TestFixable(t *testing.T) {
+	tests := []struct {
+		text string
+		want bool
+	}{
+		{"", true},
+		{"no trailing spaces\nat all\n", true},
+		{"-- \nsignature", true},
+		{"-- \r\nsignature", true},
+		{"trailing space \nhere", false},
+		{"trailing space\r\nhere \r\n", false},
+		{" \n", false},
+		{"--  \n", false},
+	}
+
+	for _, tt := range tests {
+		if got := Fixable([]byte(tt.text)); got != tt.want {
+			t.Errorf("Fixable(%q) = %t, want %t", tt.text, got, tt.want)
+		}
+	}
+}
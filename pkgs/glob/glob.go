@@ -0,0 +1,77 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package glob
+
+import (
+	"path"
+	"strings"
+)
+
+// Match reports whether name matches the shell pattern. In addition to the
+// syntax understood by path.Match, a "**" element matches zero or more
+// path elements.
+func Match(pattern, name string) bool {
+	return match(strings.Split(pattern, "/"), strings.Split(name, "/"))
+}
+
+// MatchPath is like Match, but patterns that contain no "/" are matched
+// against the last element of name, so "*.lock" matches lock files in any
+// directory.
+func MatchPath(pattern, name string) bool {
+	if !strings.Contains(pattern, "/") {
+		ok, _ := path.Match(pattern, path.Base(name))
+		return ok
+	}
+
+	return Match(pattern, name)
+}
+
+// MatchAny reports whether name matches any of the patterns.
+func MatchAny(patterns []string, name string) bool {
+	for _, p := range patterns {
+		if Match(p, name) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// MatchAnyPath reports whether name matches any of the path patterns.
+func MatchAnyPath(patterns []string, name string) bool {
+	for _, p := range patterns {
+		if MatchPath(p, name) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func match(pattern, name []string) bool {
+	for len(pattern) > 0 {
+		if pattern[0] == "**" {
+			for i := 0; i <= len(name); i++ {
+				if match(pattern[1:], name[i:]) {
+					return true
+				}
+			}
+
+			return false
+		}
+
+		if len(name) == 0 {
+			return false
+		}
+
+		if ok, _ := path.Match(pattern[0], name[0]); !ok {
+			return false
+		}
+
+		pattern, name = pattern[1:], name[1:]
+	}
+
+	return len(name) == 0
+}
@@ -0,0 +1,85 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package glob
+
+import "testing"
+
+func TestMatch(t *testing.T) {
+	tests := []struct {
+		pattern, name string
+		want          bool
+	}{
+		{"release/*", "release/1.0", true},
+		{"release/*", "release/1.0/hotfix", false},
+		{"release/*", "main", false},
+		{"*", "main", true},
+		{"*", "feature/frob", false},
+
+		{"**", "", true},
+		{"**", "a/b/c", true},
+		{"vendor/**", "vendor", true},
+		{"vendor/**", "vendor/github.com/x/y.go", true},
+		{"vendor/**", "src/vendor/y.go", false},
+		{"**/*.go", "main.go", true},
+		{"**/*.go", "cmd/mailpail/main.go", true},
+		{"**/*.go", "cmd/mailpail/README.org", false},
+		{"a/**/b", "a/b", true},
+		{"a/**/b", "a/x/y/b", true},
+		{"a/**/b", "a/x/y/c", false},
+
+		{"[A-Z]*", "INFRA", true},
+		{"[A-Z]*", "infra", false},
+		{"[^a-z]*", "INFRA", true},
+		{"v[0-9].?", "v1.2", true},
+		{"v[0-9].?", "vx.2", false},
+		{"[", "[", false},
+	}
+
+	for _, tt := range tests {
+		if got := Match(tt.pattern, tt.name); got != tt.want {
+			t.Errorf("Match(%q, %q) = %t, want %t", tt.pattern, tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestMatchPath(t *testing.T) {
+	tests := []struct {
+		pattern, name string
+		want          bool
+	}{
+		{"*.lock", "go.lock", true},
+		{"*.lock", "web/yarn.lock", true},
+		{"*.lock", "web/yarn.lock/x", false},
+		{"web/*.lock", "yarn.lock", false},
+		{"web/*.lock", "web/yarn.lock", true},
+		{"**/testdata/**", "cmd/mailpail/testdata/comment.golden", true},
+		{"[Mm]akefile", "build/Makefile", true},
+	}
+
+	for _, tt := range tests {
+		if got := MatchPath(tt.pattern, tt.name); got != tt.want {
+			t.Errorf("MatchPath(%q, %q) = %t, want %t", tt.pattern, tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestMatchAny(t *testing.T) {
+	patterns := []string{"renovate-bot", "dependabot*"}
+
+	for name, want := range map[string]bool{
+		"renovate-bot":     true,
+		"dependabot[bot]":  true,
+		"renovate-bot-two": false,
+		"jdoe":             false,
+	} {
+		if got := MatchAny(patterns, name); got != want {
+			t.Errorf("MatchAny(%q, %q) = %t, want %t", patterns, name, got, want)
+		}
+	}
+
+	if MatchAny(nil, "jdoe") {
+		t.Error("MatchAny(nil) matched")
+	}
+}
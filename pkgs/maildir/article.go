@@ -5,39 +5,130 @@
 package maildir
 
 import (
+	"errors"
+	"fmt"
 	"os"
 	"path/filepath"
+	"time"
 )
 
+// ErrCollision is returned when an article's filename is already in use.
+var ErrCollision = errors.New("maildir: filename already in use")
+
 type Article struct {
 	file     *os.File
 	filename string
+	flags    string
+	modTime  time.Time
+	replace  string
+	names    NameGenerator
 	d        Maildir
 }
 
+// Name returns the unique name of the article, which identifies it in the
+// Maildir regardless of its flags. An article replacing a message takes its
+// name.
+func (a Article) Name() string {
+	if a.replace != "" {
+		return UniqueName(a.replace)
+	}
+
+	return a.filename
+}
+
 func (a Article) Write(p []byte) (int, error) {
 	return a.file.Write(p)
 }
 
+// Close delivers the article. The file is synced to disk and linked into
+// new (or cur, when flags are set), or renamed over the message it replaces,
+// and the containing directory is synced, so once Close returns without
+// error the article survives a crash.
 func (a Article) Close() error {
-	err := a.file.Close()
-	if err != nil {
+	t := filepath.Join(string(a.d), "tmp", a.filename)
+
+	if err := a.file.Sync(); err != nil {
+		a.file.Close()
+		os.Remove(t)
+		return err
+	}
+
+	if err := a.file.Close(); err != nil {
+		os.Remove(t)
 		return err
 	}
 
 	var (
-		t = filepath.Join(string(a.d), "tmp", a.filename)
-		n = filepath.Join(string(a.d), "new", a.filename)
+		dir = filepath.Join(string(a.d), "new")
+		n   = filepath.Join(dir, a.filename)
 	)
 
-	if err := os.Link(t, n); err != nil {
+	switch {
+	case a.replace != "":
+		dir = filepath.Dir(a.replace)
+		n = a.replace
+	case a.flags != "":
+		dir = filepath.Join(string(a.d), "cur")
+		n = filepath.Join(dir, a.filename+":2,"+a.flags)
+	}
+
+	if !a.modTime.IsZero() {
+		if err := os.Chtimes(t, a.modTime, a.modTime); err != nil {
+			os.Remove(t)
+			return err
+		}
+	}
+
+	// Renaming over the replaced message swaps it atomically, as tmp is in
+	// the same Maildir, so it is never missing or delivered twice.
+	deliver := move
+	if a.replace != "" {
+		deliver = os.Rename
+	}
+
+	if err := deliver(t, n); err != nil {
+		os.Remove(t)
 		return err
 	}
 
-	if err := os.Remove(t); err != nil {
+	if err := syncDir(dir); err != nil {
 		return err
 	}
 
+	if a.replace != "" {
+		if err := a.settle(n); err != nil {
+			return err
+		}
+	}
+
+	return syncDir(filepath.Join(string(a.d), "tmp"))
+}
+
+// settle renames the article at path over any other copy of the message it
+// replaced. A mail client renaming the message after it was found, such as
+// to move it into cur or change its flags, leaves the old text under the
+// new name, so the article takes that name and its flags.
+func (a Article) settle(path string) error {
+	paths, err := a.d.Messages()
+	if err != nil {
+		return err
+	}
+
+	for _, p := range paths {
+		if p == path || UniqueName(p) != UniqueName(path) {
+			continue
+		}
+
+		if err := os.Rename(path, p); err != nil {
+			return err
+		}
+		if err := syncDir(filepath.Dir(p)); err != nil {
+			return err
+		}
+
+		return syncDir(filepath.Dir(path))
+	}
+
 	return nil
 }
 
@@ -52,3 +143,28 @@ func (a Article) Abort() error {
 
 	return nil
 }
+
+// move moves the file at oldpath to newpath without replacing an existing
+// file. Hard links are preferred, as the Maildir specification requires,
+// falling back to rename on filesystems without hard links or when tmp is
+// on another device.
+func move(oldpath, newpath string) error {
+	err := os.Link(oldpath, newpath)
+	switch {
+	case err == nil:
+		return os.Remove(oldpath)
+	case os.IsExist(err):
+		return fmt.Errorf("%w: %s", ErrCollision, newpath)
+	case !linkUnsupported(err):
+		return err
+	}
+
+	switch _, err := os.Lstat(newpath); {
+	case err == nil:
+		return fmt.Errorf("%w: %s", ErrCollision, newpath)
+	case !os.IsNotExist(err):
+		return err
+	}
+
+	return os.Rename(oldpath, newpath)
+}
@@ -0,0 +1,108 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package maildir
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// deliver writes an article with the text and options, to be closed by the
+// caller.
+func deliver(t *testing.T, d Maildir, text string, opts ...ArticleOption) *Article {
+	t.Helper()
+
+	art, err := d.NewArticle(opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := art.Write([]byte(text)); err != nil {
+		t.Fatal(err)
+	}
+
+	return art
+}
+
+func TestReplace(t *testing.T) {
+	d := Maildir(t.TempDir())
+	if err := d.Init(); err != nil {
+		t.Fatal(err)
+	}
+
+	art := deliver(t, d, "old")
+	if err := art.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	path, err := d.Find(art.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rewrite := deliver(t, d, "new", WithReplace(path))
+	if rewrite.Name() != art.Name() {
+		t.Errorf("Name() = %q, want %q", rewrite.Name(), art.Name())
+	}
+	if err := rewrite.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	checkMessages(t, d, map[string]string{path: "new"})
+}
+
+func TestReplaceRenamed(t *testing.T) {
+	d := Maildir(t.TempDir())
+	if err := d.Init(); err != nil {
+		t.Fatal(err)
+	}
+
+	art := deliver(t, d, "old")
+	if err := art.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	path, err := d.Find(art.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rewrite := deliver(t, d, "new", WithReplace(path))
+
+	// The mail client marks the message as seen before it is replaced.
+	seen := filepath.Join(string(d), "cur", art.Name()+":2,S")
+	if err := os.Rename(path, seen); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := rewrite.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	checkMessages(t, d, map[string]string{seen: "new"})
+}
+
+func checkMessages(t *testing.T, d Maildir, want map[string]string) {
+	t.Helper()
+
+	paths, err := d.Messages()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(paths) != len(want) {
+		t.Errorf("Messages() = %q, want %d messages", paths, len(want))
+	}
+
+	for path, text := range want {
+		b, err := os.ReadFile(path)
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+		if string(b) != text {
+			t.Errorf("%s = %q, want %q", path, b, text)
+		}
+	}
+}
@@ -0,0 +1,106 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package maildir
+
+import (
+	"crypto/rand"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// A NameGenerator generates the unique filenames of new articles.
+type NameGenerator interface {
+	UniqueName() (string, error)
+}
+
+var (
+	deliveries int64 = 10000
+
+	defaultOnce      sync.Once
+	defaultGenerator NameGenerator
+	defaultErr       error
+)
+
+// DefaultNameGenerator returns the preferred NameGenerator for this system,
+// which is determined the first time it is needed.
+func DefaultNameGenerator() (NameGenerator, error) {
+	defaultOnce.Do(func() {
+		defaultGenerator, defaultErr = newDefaultGenerator()
+	})
+
+	return defaultGenerator, defaultErr
+}
+
+// WithNameGenerator sets the NameGenerator used to name the article,
+// instead of the DefaultNameGenerator.
+func WithNameGenerator(g NameGenerator) ArticleOption {
+	return func(a *Article) {
+		a.names = g
+	}
+}
+
+// clock is the source of the time and randomness in filenames, which tests
+// replace to make filenames deterministic.
+type clock struct {
+	now  func() time.Time
+	rand io.Reader
+}
+
+var systemClock = clock{now: time.Now, rand: rand.Reader}
+
+type hostnameGenerator struct {
+	hostname string
+	pid      int
+	clock
+}
+
+// NewHostnameGenerator returns a NameGenerator that returns filenames in the
+// following format:
+//
+//  {timestamp}.P{pid}Q{delivery}R{random}M{millisecond}.{hostname}
+//
+// Where `timestamp` is the number of elasped seconds since 1 January 1970 UTC,
+// `pid` is the process ID of this mailpail instance, `delivery` is a monotonically
+// increasing number representing the number of messages delivered by this process,
+// `random` is a 10 byte random number, `millisecond` is the millisecond component
+// of the earlier timestamp, and `hostname` is the system hostname (with "/" and ":"
+// characters escaped).
+func NewHostnameGenerator() (NameGenerator, error) {
+	hostname, err := os.Hostname()
+	if err != nil {
+		return nil, fmt.Errorf("unable to determine hostname: %w", err)
+	}
+	hostname = strings.ReplaceAll(hostname, "/", "\\057")
+	hostname = strings.ReplaceAll(hostname, ":", "\\072")
+
+	return &hostnameGenerator{
+		hostname: hostname,
+		pid:      os.Getpid(),
+		clock:    systemClock,
+	}, nil
+}
+
+func (g *hostnameGenerator) UniqueName() (string, error) {
+	now := g.now()
+
+	bs := make([]byte, 10)
+	if _, err := io.ReadFull(g.rand, bs); err != nil {
+		return "", err
+	}
+
+	return fmt.Sprintf("%d.P%dQ%dR%xM%d.%s",
+		now.Unix(),
+		g.pid,
+		atomic.AddInt64(&deliveries, 1),
+		bs,
+		now.UnixNano()/1000%1000,
+		g.hostname,
+	), nil
+}
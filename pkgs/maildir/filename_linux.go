@@ -7,22 +7,18 @@ package maildir
 import (
 	"bytes"
 	"crypto/hmac"
-	"crypto/rand"
 	"crypto/sha256"
 	"fmt"
 	"io"
 	"os"
 	"sync/atomic"
-	"time"
 
 	"github.com/google/uuid"
 )
 
 var (
-	deliveries int64 = 10000
-	bootID     uuid.UUID
-	machineID  uuid.UUID
-	pid        int
+	machineIDFiles = []string{"/etc/machine-id", "/var/lib/dbus/machine-id"}
+	bootIDFile     = "/proc/sys/kernel/random/boot_id"
 
 	applicationID = [16]byte{
 		0x06, 0x0e, 0x97, 0x74, 0x4c, 0x65, 0x49, 0x95,
@@ -30,20 +26,36 @@ var (
 	}
 )
 
-func init() {
-	mid, err := os.ReadFile("/var/lib/dbus/machine-id")
-	if err != nil {
-		panic(fmt.Sprintf("unable to read machine-id: %s", err))
+// newDefaultGenerator prefers the machine and boot IDs, falling back to the
+// hostname where they are unavailable, such as in minimal containers.
+func newDefaultGenerator() (NameGenerator, error) {
+	if g, err := NewMachineIDGenerator(); err == nil {
+		return g, nil
 	}
-	machineID = appID(uuid.Must(uuid.ParseBytes(bytes.TrimSpace(mid))), applicationID)
 
-	bid, err := os.ReadFile("/proc/sys/kernel/random/boot_id")
-	if err != nil {
-		panic(fmt.Sprintf("unable to read boot-id: %s", err))
+	return NewHostnameGenerator()
+}
+
+// readID reads and parses the first valid ID from files, skipping those
+// that cannot be read or parsed.
+func readID(files ...string) (uuid.UUID, error) {
+	var err error
+	for _, file := range files {
+		var b []byte
+		if b, err = os.ReadFile(file); err != nil {
+			continue
+		}
+
+		var id uuid.UUID
+		if id, err = uuid.ParseBytes(bytes.TrimSpace(b)); err != nil {
+			err = fmt.Errorf("parsing %s: %w", file, err)
+			continue
+		}
+
+		return id, nil
 	}
-	bootID = appID(uuid.Must(uuid.ParseBytes(bytes.TrimSpace(bid))), applicationID)
 
-	pid = os.Getpid()
+	return uuid.UUID{}, err
 }
 
 // appID takes a base ID (eg, machine-id and boot-id) and returns
@@ -66,7 +78,15 @@ func appID(base [16]byte, app [16]byte) uuid.UUID {
 	return uuid.Must(uuid.FromBytes(id))
 }
 
-// uniqueFilename on Linux systems returns filenames in the following format:
+type machineIDGenerator struct {
+	bootID    uuid.UUID
+	machineID uuid.UUID
+	pid       int
+	clock
+}
+
+// NewMachineIDGenerator returns a NameGenerator that returns filenames in the
+// following format:
 //
 //   {timestamp}.X{boot-id}P{pid}Q{delivery}R{random}M{millisecond}.D{machine-id}
 //
@@ -80,21 +100,40 @@ func appID(base [16]byte, app [16]byte) uuid.UUID {
 // To deter drawing correlations between mailpail and other applications using the
 // machine and boot IDs, the mailpail uses app specific forms of the identifiers:
 // an HMAC hash of an appliction ID keyed by the corresponding system IDs.
-func uniqueFilename() (string, error) {
-	now := time.Now()
+func NewMachineIDGenerator() (NameGenerator, error) {
+	mid, err := readID(machineIDFiles...)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read machine-id: %w", err)
+	}
+
+	bid, err := readID(bootIDFile)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read boot-id: %w", err)
+	}
+
+	return &machineIDGenerator{
+		bootID:    appID(bid, applicationID),
+		machineID: appID(mid, applicationID),
+		pid:       os.Getpid(),
+		clock:     systemClock,
+	}, nil
+}
+
+func (g *machineIDGenerator) UniqueName() (string, error) {
+	now := g.now()
 
 	bs := make([]byte, 10)
-	if _, err := io.ReadFull(rand.Reader, bs); err != nil {
+	if _, err := io.ReadFull(g.rand, bs); err != nil {
 		return "", err
 	}
 
 	return fmt.Sprintf("%d.X%sP%dQ%dR%xM%d.D%s",
 		now.Unix(),
-		bootID,
-		pid,
+		g.bootID,
+		g.pid,
 		atomic.AddInt64(&deliveries, 1),
 		bs,
 		now.UnixNano()/1000%1000,
-		machineID,
+		g.machineID,
 	), nil
 }
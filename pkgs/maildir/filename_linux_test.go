@@ -0,0 +1,63 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package maildir
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+func TestMachineIDGeneratorUniqueName(t *testing.T) {
+	g := &machineIDGenerator{
+		bootID:    uuid.MustParse("11111111-2222-4333-8444-555555555555"),
+		machineID: uuid.MustParse("66666666-7777-4888-9999-aaaaaaaaaaaa"),
+		pid:       42,
+		clock:     fixedClock(),
+	}
+
+	q := atomic.LoadInt64(&deliveries) + 1
+	name, err := g.UniqueName()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := fmt.Sprintf("1600000000.X11111111-2222-4333-8444-555555555555P42Q%dRababababababababababM456.D66666666-7777-4888-9999-aaaaaaaaaaaa", q)
+	if name != want {
+		t.Errorf("UniqueName() = %q, want %q", name, want)
+	}
+}
+
+func TestReadIDFallsBack(t *testing.T) {
+	dir := t.TempDir()
+	var (
+		missing = filepath.Join(dir, "missing")
+		invalid = filepath.Join(dir, "invalid")
+		valid   = filepath.Join(dir, "valid")
+	)
+
+	if err := os.WriteFile(invalid, []byte("not an id\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(valid, []byte("0123456789abcdef0123456789abcdef\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	id, err := readID(missing, invalid, valid)
+	if err != nil {
+		t.Fatalf("readID() error = %v", err)
+	}
+	if want := uuid.MustParse("01234567-89ab-cdef-0123-456789abcdef"); id != want {
+		t.Errorf("readID() = %s, want %s", id, want)
+	}
+
+	if _, err := readID(missing, invalid); err == nil {
+		t.Error("readID() of no valid files succeeded")
+	}
+}
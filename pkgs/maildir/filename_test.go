@@ -0,0 +1,39 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package maildir
+
+import (
+	"bytes"
+	"fmt"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// fixedClock returns a clock stopped at a known time, with known random
+// bytes.
+func fixedClock() clock {
+	return clock{
+		now: func() time.Time {
+			return time.Unix(1600000000, 123456000)
+		},
+		rand: bytes.NewReader(bytes.Repeat([]byte{0xab}, 10)),
+	}
+}
+
+func TestHostnameGeneratorUniqueName(t *testing.T) {
+	g := &hostnameGenerator{hostname: "host\\057name", pid: 42, clock: fixedClock()}
+
+	q := atomic.LoadInt64(&deliveries) + 1
+	name, err := g.UniqueName()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := fmt.Sprintf("1600000000.P42Q%dRababababababababababM456.host\\057name", q)
+	if name != want {
+		t.Errorf("UniqueName() = %q, want %q", name, want)
+	}
+}
@@ -5,27 +5,170 @@
 package maildir
 
 import (
+	"fmt"
+	"io/ioutil"
 	"os"
 	"path/filepath"
+	"strings"
+	"time"
 )
 
 type Maildir string
 
-func (d Maildir) NewArticle() (*Article, error) {
-	fn, err := uniqueFilename()
-	if err != nil {
-		return nil, err
+// Folder returns the Maildir++ subfolder with the provided name. Nested
+// folders are separated by ".", as in "Projects.mailpail".
+func (d Maildir) Folder(name string) Maildir {
+	return Maildir(filepath.Join(string(d), "."+name))
+}
+
+// Init creates the tmp, cur, and new directories of the Maildir if they do
+// not already exist.
+func (d Maildir) Init() error {
+	for _, sub := range []string{"tmp", "cur", "new"} {
+		if err := os.MkdirAll(filepath.Join(string(d), sub), 0744); err != nil {
+			return err
+		}
 	}
 
+	return nil
+}
+
+func (d Maildir) NewArticle(opts ...ArticleOption) (*Article, error) {
 	art := &Article{}
-	file, err := os.Create(filepath.Join(string(d), "tmp", fn))
+	for _, opt := range opts {
+		opt(art)
+	}
+
+	if art.names == nil {
+		g, err := DefaultNameGenerator()
+		if err != nil {
+			return nil, err
+		}
+		art.names = g
+	}
+
+	fn, err := art.names.UniqueName()
 	if err != nil {
 		return nil, err
 	}
 
+	file, err := os.OpenFile(filepath.Join(string(d), "tmp", fn), os.O_RDWR|os.O_CREATE|os.O_EXCL, 0644)
+	switch {
+	case os.IsExist(err):
+		return nil, fmt.Errorf("%w: %s", ErrCollision, fn)
+	case err != nil:
+		return nil, err
+	}
+
 	art.file = file
 	art.filename = fn
 	art.d = d
 
 	return art, nil
 }
+
+// Messages returns the paths of the delivered messages in cur and new.
+func (d Maildir) Messages() ([]string, error) {
+	var paths []string
+	for _, sub := range []string{"cur", "new"} {
+		dir := filepath.Join(string(d), sub)
+		entries, err := ioutil.ReadDir(dir)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, e := range entries {
+			if !e.IsDir() && !strings.HasPrefix(e.Name(), ".") {
+				paths = append(paths, filepath.Join(dir, e.Name()))
+			}
+		}
+	}
+
+	return paths, nil
+}
+
+// Find returns the path of the message with the unique name in cur or new,
+// whatever its flags. The error satisfies os.IsNotExist if there is none.
+func (d Maildir) Find(name string) (string, error) {
+	paths, err := d.Messages()
+	if err != nil {
+		return "", err
+	}
+
+	for _, path := range paths {
+		if UniqueName(path) == name {
+			return path, nil
+		}
+	}
+
+	return "", &os.PathError{Op: "find", Path: filepath.Join(string(d), name), Err: os.ErrNotExist}
+}
+
+// UniqueName returns the unique name of the message file at path, without
+// the directory or the info section holding its flags.
+func UniqueName(path string) string {
+	name := filepath.Base(path)
+	if i := strings.IndexByte(name, ':'); i >= 0 {
+		name = name[:i]
+	}
+
+	return name
+}
+
+// Folders returns the Maildir++ subfolders of the Maildir.
+func (d Maildir) Folders() ([]Maildir, error) {
+	entries, err := ioutil.ReadDir(string(d))
+	if err != nil {
+		return nil, err
+	}
+
+	var folders []Maildir
+	for _, e := range entries {
+		if !e.IsDir() || !strings.HasPrefix(e.Name(), ".") || e.Name() == "." || e.Name() == ".." {
+			continue
+		}
+
+		folder := Maildir(filepath.Join(string(d), e.Name()))
+		if fi, err := os.Stat(filepath.Join(string(folder), "cur")); err == nil && fi.IsDir() {
+			folders = append(folders, folder)
+		}
+	}
+
+	return folders, nil
+}
+
+// StaleTmp returns the paths of files in tmp that have not been modified
+// for longer than age. The Maildir specification suggests 36 hours, after
+// which a delivery can be assumed to have been abandoned.
+func (d Maildir) StaleTmp(age time.Duration) ([]string, error) {
+	tmp := filepath.Join(string(d), "tmp")
+	entries, err := ioutil.ReadDir(tmp)
+	if err != nil {
+		return nil, err
+	}
+
+	var paths []string
+	for _, e := range entries {
+		if !e.IsDir() && time.Since(e.ModTime()) >= age {
+			paths = append(paths, filepath.Join(tmp, e.Name()))
+		}
+	}
+
+	return paths, nil
+}
+
+// CleanTmp removes the files from tmp returned by StaleTmp.
+func (d Maildir) CleanTmp(age time.Duration) error {
+	paths, err := d.StaleTmp(age)
+	if err != nil {
+		return err
+	}
+
+	for _, path := range paths {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,60 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package maildir
+
+import (
+	"sort"
+	"strings"
+	"time"
+)
+
+// Flags are the Maildir flags: draft, flagged, passed, replied, seen and
+// trashed.
+const Flags = "DFPRST"
+
+// An ArticleOption configures how a new article is delivered.
+type ArticleOption func(*Article)
+
+// WithFlags adds Maildir flags to the article, such as "S" (seen), "F"
+// (flagged) or "T" (trashed). Articles with flags are delivered straight
+// into cur instead of new. The option may be given more than once.
+func WithFlags(flags string) ArticleOption {
+	return func(a *Article) {
+		a.flags = normalizeFlags(a.flags + flags)
+	}
+}
+
+// WithModTime sets the modification time of the delivered file, for mail
+// clients that sort messages by file time.
+func WithModTime(t time.Time) ArticleOption {
+	return func(a *Article) {
+		a.modTime = t
+	}
+}
+
+// WithReplace replaces the message at path with the article, which is
+// renamed over it, keeping its name and flags. The message is only replaced
+// once the article is written, and flags given with WithFlags are ignored.
+func WithReplace(path string) ArticleOption {
+	return func(a *Article) {
+		a.replace = path
+	}
+}
+
+// normalizeFlags returns flags sorted in ASCII order without duplicates, as
+// required for the info section of a Maildir filename.
+func normalizeFlags(flags string) string {
+	fs := strings.Split(flags, "")
+	sort.Strings(fs)
+
+	var b strings.Builder
+	for i, f := range fs {
+		if i == 0 || fs[i-1] != f {
+			b.WriteString(f)
+		}
+	}
+
+	return b.String()
+}
@@ -0,0 +1,23 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+// +build windows plan9
+
+package maildir
+
+import (
+	"os"
+)
+
+// syncDir is a no-op, as directories cannot be synced on these systems.
+func syncDir(dir string) error {
+	return nil
+}
+
+// linkUnsupported reports whether err indicates the filesystem cannot hard
+// link the file. Without portable error numbers, any failure other than an
+// existing file falls back to rename.
+func linkUnsupported(err error) bool {
+	return !os.IsExist(err)
+}
@@ -0,0 +1,47 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+// +build !windows,!plan9
+
+package maildir
+
+import (
+	"errors"
+	"os"
+	"syscall"
+)
+
+// syncDir flushes the directory entries of dir to disk.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+
+	if err := d.Sync(); err != nil {
+		d.Close()
+		return err
+	}
+
+	return d.Close()
+}
+
+// linkUnsupported reports whether err indicates the filesystem cannot hard
+// link the file, rather than a failure of the delivery itself.
+func linkUnsupported(err error) bool {
+	for _, errno := range []syscall.Errno{
+		syscall.EXDEV,
+		syscall.EPERM,
+		syscall.EMLINK,
+		syscall.ENOTSUP,
+		syscall.EOPNOTSUPP,
+		syscall.ENOSYS,
+	} {
+		if errors.Is(err, errno) {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,343 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+// Package plaintext renders Bitbucket markdown as plain text, in the style
+// of a message written by hand: links are numbered and listed at the end,
+// code blocks are indented, and tables are aligned.
+package plaintext
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/yuin/goldmark"
+	"github.com/yuin/goldmark/ast"
+	"github.com/yuin/goldmark/extension"
+	east "github.com/yuin/goldmark/extension/ast"
+	"github.com/yuin/goldmark/text"
+)
+
+// Options configures how markdown is rendered.
+type Options struct {
+	// Width is the column prose is wrapped at. When zero, paragraphs are
+	// left on a line each, to be wrapped by format=flowed.
+	Width int
+	// Mention returns the name of a user mentioned as @{slug}.
+	Mention func(slug string) string
+	// Fixed is prepended to the lines of code blocks and tables, to mark
+	// them for the writer of the text as lines that must not be wrapped.
+	Fixed string
+}
+
+var parser = goldmark.New(goldmark.WithExtensions(extension.GFM)).Parser()
+
+var (
+	mentionPattern = regexp.MustCompile(`@\{([^}]+)\}`)
+	// escapePattern matches punctuation escaped with a backslash.
+	escapePattern = regexp.MustCompile("\\\\([!-/:-@\\[-`{-~])")
+)
+
+// Render renders the markdown as plain text.
+func Render(source string, opts Options) string {
+	src := []byte(strings.ReplaceAll(source, "\r\n", "\n"))
+	r := &renderer{
+		source: src,
+		opts:   opts,
+		refs:   make(map[string]int),
+	}
+
+	lines := r.children(parser.Parse(text.NewReader(src)), opts.Width, false)
+	if len(r.urls) > 0 {
+		lines = append(lines, "")
+		for i, url := range r.urls {
+			lines = append(lines, fmt.Sprintf("[%d] %s", i+1, url))
+		}
+	}
+
+	return strings.Join(lines, "\n")
+}
+
+type renderer struct {
+	source []byte
+	opts   Options
+	// urls are the links referenced so far, numbered from one, and refs
+	// their numbers.
+	urls []string
+	refs map[string]int
+}
+
+// children renders the blocks within n, separated by blank lines unless
+// they are tight.
+func (r *renderer) children(n ast.Node, width int, tight bool) []string {
+	var lines []string
+	for c := n.FirstChild(); c != nil; c = c.NextSibling() {
+		block := r.block(c, width)
+		if block == nil {
+			continue
+		}
+
+		if len(lines) > 0 && !tight {
+			lines = append(lines, "")
+		}
+		lines = append(lines, block...)
+	}
+
+	return lines
+}
+
+// block renders a block as lines of at most width columns, where they can
+// be wrapped.
+func (r *renderer) block(n ast.Node, width int) []string {
+	switch n := n.(type) {
+	case *ast.Paragraph, *ast.TextBlock:
+		return wrap(r.inline(n), width)
+	case *ast.Heading:
+		title := r.inline(n)
+		switch n.Level {
+		case 1:
+			return []string{title, strings.Repeat("=", utf8.RuneCountInString(title))}
+		case 2:
+			return []string{title, strings.Repeat("-", utf8.RuneCountInString(title))}
+		}
+		return []string{strings.Repeat("#", n.Level) + " " + title}
+	case *ast.ThematicBreak:
+		return []string{"---"}
+	case *ast.CodeBlock, *ast.FencedCodeBlock:
+		var lines []string
+		segments := n.Lines()
+		for i := 0; i < segments.Len(); i++ {
+			segment := segments.At(i)
+			line := strings.TrimRight(string(segment.Value(r.source)), "\n")
+			if strings.TrimSpace(line) == "" {
+				lines = append(lines, "")
+				continue
+			}
+			lines = append(lines, r.opts.Fixed+"    "+line)
+		}
+		return lines
+	case *ast.Blockquote:
+		lines := r.children(n, width-2, false)
+		for i, line := range lines {
+			if line == "" {
+				lines[i] = ">"
+				continue
+			}
+			lines[i] = "> " + line
+		}
+		return lines
+	case *ast.List:
+		return r.list(n, width)
+	case *ast.HTMLBlock:
+		// Raw HTML is omitted, as it is when rendering HTML.
+		return nil
+	case *east.Table:
+		return r.table(n)
+	}
+
+	return r.children(n, width, false)
+}
+
+// list renders the items of the list after their markers, with the lines
+// following the first indented to match.
+func (r *renderer) list(n *ast.List, width int) []string {
+	var lines []string
+	i := 0
+	for item := n.FirstChild(); item != nil; item = item.NextSibling() {
+		marker := "-"
+		if n.IsOrdered() {
+			marker = fmt.Sprintf("%d.", n.Start+i)
+		}
+		indent := strings.Repeat(" ", len(marker)+1)
+
+		if i > 0 && !n.IsTight {
+			lines = append(lines, "")
+		}
+
+		for j, line := range r.children(item, width-len(indent), n.IsTight) {
+			switch {
+			case j == 0:
+				line = marker + " " + line
+			case line != "":
+				line = indent + line
+			}
+			lines = append(lines, line)
+		}
+		i++
+	}
+
+	return lines
+}
+
+// table renders the table with its columns aligned, and the header
+// underlined.
+func (r *renderer) table(n *east.Table) []string {
+	var (
+		rows   [][]string
+		widths []int
+	)
+
+	for row := n.FirstChild(); row != nil; row = row.NextSibling() {
+		var cells []string
+		for cell := row.FirstChild(); cell != nil; cell = cell.NextSibling() {
+			text := r.inline(cell)
+			if len(cells) == len(widths) {
+				widths = append(widths, 0)
+			}
+			if w := utf8.RuneCountInString(text); w > widths[len(cells)] {
+				widths[len(cells)] = w
+			}
+			cells = append(cells, text)
+		}
+		rows = append(rows, cells)
+	}
+
+	var lines []string
+	for i, cells := range rows {
+		padded := make([]string, len(cells))
+		for j, cell := range cells {
+			var align east.Alignment
+			if j < len(n.Alignments) {
+				align = n.Alignments[j]
+			}
+			padded[j] = pad(cell, widths[j], align)
+		}
+		lines = append(lines, r.opts.Fixed+strings.TrimRight(strings.Join(padded, "  "), " "))
+
+		if i == 0 {
+			rules := make([]string, len(widths))
+			for j, w := range widths {
+				rules[j] = strings.Repeat("-", w)
+			}
+			lines = append(lines, r.opts.Fixed+strings.Join(rules, "  "))
+		}
+	}
+
+	return lines
+}
+
+func pad(text string, width int, align east.Alignment) string {
+	space := width - utf8.RuneCountInString(text)
+	switch align {
+	case east.AlignRight:
+		return strings.Repeat(" ", space) + text
+	case east.AlignCenter:
+		return strings.Repeat(" ", space/2) + text + strings.Repeat(" ", space-space/2)
+	}
+
+	return text + strings.Repeat(" ", space)
+}
+
+// inline renders the inline content of n on a single line, apart from hard
+// line breaks.
+func (r *renderer) inline(n ast.Node) string {
+	var b strings.Builder
+	for c := n.FirstChild(); c != nil; c = c.NextSibling() {
+		switch c := c.(type) {
+		case *ast.Text:
+			b.WriteString(r.mentions(escapePattern.ReplaceAllString(string(c.Segment.Value(r.source)), "$1")))
+			switch {
+			case c.HardLineBreak():
+				b.WriteString("\n")
+			case c.SoftLineBreak():
+				b.WriteString(" ")
+			}
+		case *ast.String:
+			b.WriteString(r.mentions(string(c.Value)))
+		case *ast.CodeSpan:
+			b.WriteString("`" + string(c.Text(r.source)) + "`")
+		case *ast.Emphasis:
+			mark := "_"
+			if c.Level > 1 {
+				mark = "*"
+			}
+			b.WriteString(mark + r.inline(c) + mark)
+		case *ast.Link:
+			label, url := r.inline(c), string(c.Destination)
+			if label == url {
+				b.WriteString(url)
+				continue
+			}
+			b.WriteString(fmt.Sprintf("%s [%d]", label, r.ref(url)))
+		case *ast.Image:
+			label := "[image]"
+			if alt := r.inline(c); alt != "" {
+				label = "[image: " + alt + "]"
+			}
+			b.WriteString(fmt.Sprintf("%s [%d]", label, r.ref(string(c.Destination))))
+		case *ast.AutoLink:
+			b.WriteString(string(c.Label(r.source)))
+		case *ast.RawHTML:
+		case *east.Strikethrough:
+			b.WriteString("~~" + r.inline(c) + "~~")
+		case *east.TaskCheckBox:
+			if c.IsChecked {
+				b.WriteString("[x] ")
+			} else {
+				b.WriteString("[ ] ")
+			}
+		default:
+			b.WriteString(r.inline(c))
+		}
+	}
+
+	return b.String()
+}
+
+// mentions replaces the mentions of users with their names.
+func (r *renderer) mentions(s string) string {
+	if r.opts.Mention == nil {
+		return s
+	}
+
+	return mentionPattern.ReplaceAllStringFunc(s, func(m string) string {
+		return "@" + r.opts.Mention(m[2:len(m)-1])
+	})
+}
+
+// ref returns the number of the link to url.
+func (r *renderer) ref(url string) int {
+	if n, ok := r.refs[url]; ok {
+		return n
+	}
+
+	r.urls = append(r.urls, url)
+	r.refs[url] = len(r.urls)
+	return len(r.urls)
+}
+
+// wrap wraps each line of the text at width columns, without breaking
+// words. Lines are not wrapped when width is zero.
+func wrap(text string, width int) []string {
+	var lines []string
+	for _, line := range strings.Split(strings.TrimRight(text, " \n"), "\n") {
+		line = strings.TrimRight(line, " ")
+		if width <= 0 {
+			lines = append(lines, line)
+			continue
+		}
+
+		var (
+			cur    string
+			curLen int
+		)
+		for _, word := range strings.Fields(line) {
+			n := utf8.RuneCountInString(word)
+			if curLen > 0 && curLen+1+n > width {
+				lines = append(lines, cur)
+				cur, curLen = "", 0
+			}
+			if curLen > 0 {
+				cur += " "
+				curLen++
+			}
+			cur += word
+			curLen += n
+		}
+		lines = append(lines, cur)
+	}
+
+	return lines
+}
@@ -0,0 +1,171 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package plaintext
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestRender(t *testing.T) {
+	names := map[string]string{"jdoe": "Jane Doe"}
+	opts := Options{
+		Width: 30,
+		Mention: func(slug string) string {
+			if name, ok := names[slug]; ok {
+				return name
+			}
+			return slug
+		},
+	}
+
+	tests := []struct {
+		name     string
+		markdown string
+		want     []string
+	}{
+		{
+			name:     "paragraphs",
+			markdown: "This paragraph is long enough to be wrapped.\n\nA second one.",
+			want: []string{
+				"This paragraph is long enough",
+				"to be wrapped.",
+				"",
+				"A second one.",
+			},
+		},
+		{
+			name:     "numbered links",
+			markdown: "See [the docs](https://example.com/docs), the [spec](https://example.com/spec) and [the docs](https://example.com/docs) again.",
+			want: []string{
+				"See the docs [1], the spec [2]",
+				"and the docs [1] again.",
+				"",
+				"[1] https://example.com/docs",
+				"[2] https://example.com/spec",
+			},
+		},
+		{
+			name:     "autolinks and images",
+			markdown: "<https://example.com>\n\n![diagram](https://example.com/d.png)",
+			want: []string{
+				"https://example.com",
+				"",
+				"[image: diagram] [1]",
+				"",
+				"[1] https://example.com/d.png",
+			},
+		},
+		{
+			name:     "mentions",
+			markdown: "Thanks @{jdoe}, and @{asmith}.",
+			want:     []string{"Thanks @Jane Doe, and @asmith."},
+		},
+		{
+			name:     "emphasis",
+			markdown: "Some *emphasis*, **strong**, ~~struck~~ and `code`.",
+			want: []string{
+				"Some _emphasis_, *strong*,",
+				"~~struck~~ and `code`.",
+			},
+		},
+		{
+			name:     "tight list",
+			markdown: "- one\n- a second item that wraps onto another line\n  - nested",
+			want: []string{
+				"- one",
+				"- a second item that wraps",
+				"  onto another line",
+				"  - nested",
+			},
+		},
+		{
+			name:     "ordered list",
+			markdown: "3. three\n\n4. four\n\n   more about four",
+			want: []string{
+				"3. three",
+				"",
+				"4. four",
+				"",
+				"   more about four",
+			},
+		},
+		{
+			name:     "task list",
+			markdown: "- [x] done\n- [ ] to do",
+			want: []string{
+				"- [x] done",
+				"- [ ] to do",
+			},
+		},
+		{
+			name:     "code block",
+			markdown: "Run:\n\n```go\nif frob := frobnicate(x); frob > 0 {\n\n\treturn frob\n}\n```",
+			want: []string{
+				"Run:",
+				"",
+				"    if frob := frobnicate(x); frob > 0 {",
+				"",
+				"    \treturn frob",
+				"    }",
+			},
+		},
+		{
+			name:     "table",
+			markdown: "| Name | Count | Status |\n|:-----|------:|:------:|\n| frob | 1 | ok |\n| nicate | 100 | failed |",
+			want: []string{
+				"Name    Count  Status",
+				"------  -----  ------",
+				"frob        1    ok",
+				"nicate    100  failed",
+			},
+		},
+		{
+			name:     "quotes and headings",
+			markdown: "# Title\n\n> quoted\n>\n> text\n\n### Small",
+			want: []string{
+				"Title",
+				"=====",
+				"",
+				"> quoted",
+				">",
+				"> text",
+				"",
+				"### Small",
+			},
+		},
+		{
+			name:     "html and escapes",
+			markdown: "<div>hidden</div>\n\nAn \\*escaped\\* star.",
+			want:     []string{"An *escaped* star."},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := Render(tt.markdown, opts)
+			if want := strings.Join(tt.want, "\n"); got != want {
+				t.Errorf("Render(%q) =\n%s\nwant\n%s", tt.markdown, got, want)
+			}
+		})
+	}
+}
+
+func TestRenderFixed(t *testing.T) {
+	markdown := "Some prose.\n\n    code\n\n| a | b |\n|---|---|\n| 1 | 2 |"
+	want := strings.Join([]string{
+		"Some prose.",
+		"",
+		"\x00    code",
+		"",
+		"\x00a  b",
+		"\x00-  -",
+		"\x001  2",
+	}, "\n")
+
+	if got := Render(markdown, Options{Fixed: "\x00"}); got != want {
+		t.Errorf("Render() = %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,196 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+// Package rules implements sieve-like routing and filtering of messages
+// before they are delivered into a Maildir.
+package rules
+
+import (
+	"fmt"
+	"net/textproto"
+	"strings"
+
+	"github.com/terinjokes/mailpail/pkgs/glob"
+	"github.com/terinjokes/mailpail/pkgs/maildir"
+)
+
+// Message describes a message about to be delivered, as seen by the rules.
+type Message struct {
+	Project   string
+	Repo      string
+	ID        int
+	Author    string
+	Reviewers []string
+	Branch    string
+	Action    string
+	Labels    []string
+	Paths     []string
+}
+
+// Match selects messages. Every non-empty field must match the message, and
+// a field matches if any of its glob patterns matches.
+type Match struct {
+	Projects  []string `edn:"projects,omitempty"`
+	Repos     []string `edn:"repos,omitempty"`
+	Authors   []string `edn:"authors,omitempty"`
+	Reviewers []string `edn:"reviewers,omitempty"`
+	Branches  []string `edn:"branches,omitempty"`
+	Actions   []string `edn:"actions,omitempty"`
+	Labels    []string `edn:"labels,omitempty"`
+	Paths     []string `edn:"paths,omitempty"`
+}
+
+// Rule describes the actions applied to messages selected by Match.
+type Rule struct {
+	Name    string            `edn:"name"`
+	Match   Match             `edn:"match"`
+	Folder  string            `edn:"folder,omitempty"`
+	Flags   string            `edn:"flags,omitempty"`
+	Headers map[string]string `edn:"headers,omitempty"`
+	Drop    bool              `edn:"drop,omitempty"`
+}
+
+// Rules is an ordered list of rules; the first matching rule wins.
+type Rules []Rule
+
+// reserved are the header fields set by mailpail, which rules may not add.
+var reserved = map[string]bool{
+	"Archived-At":               true,
+	"Cc":                        true,
+	"Content-Disposition":       true,
+	"Content-Transfer-Encoding": true,
+	"Content-Type":              true,
+	"Date":                      true,
+	"From":                      true,
+	"In-Reply-To":               true,
+	"List-Id":                   true,
+	"Message-Id":                true,
+	"Mime-Version":              true,
+	"Received":                  true,
+	"References":                true,
+	"Reply-To":                  true,
+	"Sender":                    true,
+	"Subject":                   true,
+	"To":                        true,
+}
+
+// Validate reports the first rule that cannot be applied: one adding a
+// header field set by mailpail, setting flags that are not Maildir flags, or
+// delivering into a folder outside the Maildir.
+func (rs Rules) Validate() error {
+	for i, r := range rs {
+		if err := r.validate(); err != nil {
+			name := r.Name
+			if name == "" {
+				name = fmt.Sprintf("#%d", i+1)
+			}
+
+			return fmt.Errorf("rule %s: %w", name, err)
+		}
+	}
+
+	return nil
+}
+
+func (r Rule) validate() error {
+	for k := range r.Headers {
+		key := textproto.CanonicalMIMEHeaderKey(k)
+		if reserved[key] || strings.HasPrefix(key, "X-Mailpail-") {
+			return fmt.Errorf("header %s is reserved", k)
+		}
+		if k == "" || strings.ContainsAny(k, ": \t\r\n") {
+			return fmt.Errorf("invalid header name %q", k)
+		}
+	}
+
+	for _, f := range r.Flags {
+		if !strings.ContainsRune(maildir.Flags, f) {
+			return fmt.Errorf("unknown flag %q, want one of %s", f, maildir.Flags)
+		}
+	}
+
+	if strings.Contains(r.Folder, "/") || strings.Contains(r.Folder, "..") {
+		return fmt.Errorf("invalid folder %q", r.Folder)
+	}
+
+	return nil
+}
+
+// Evaluate returns the first rule matching the message.
+func (rs Rules) Evaluate(m Message) (Rule, bool) {
+	for _, r := range rs {
+		if r.Match.Matches(m) {
+			return r, true
+		}
+	}
+
+	return Rule{}, false
+}
+
+// NeedPaths reports whether any rule matches on the paths touched by the
+// pull request, which are expensive to fetch.
+func (rs Rules) NeedPaths() bool {
+	for _, r := range rs {
+		if len(r.Match.Paths) > 0 {
+			return true
+		}
+	}
+
+	return false
+}
+
+// NeedLabels reports whether any rule matches on repository labels.
+func (rs Rules) NeedLabels() bool {
+	for _, r := range rs {
+		if len(r.Match.Labels) > 0 {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Matches reports whether the message is selected.
+func (mt Match) Matches(m Message) bool {
+	return matchOne(mt.Projects, m.Project) &&
+		matchOne(mt.Repos, m.Repo) &&
+		matchOne(mt.Authors, m.Author) &&
+		matchSome(mt.Reviewers, m.Reviewers) &&
+		matchOne(mt.Branches, m.Branch) &&
+		matchOne(mt.Actions, m.Action) &&
+		matchSome(mt.Labels, m.Labels) &&
+		matchPaths(mt.Paths, m.Paths)
+}
+
+func matchOne(patterns []string, value string) bool {
+	return len(patterns) == 0 || glob.MatchAny(patterns, value)
+}
+
+func matchSome(patterns []string, values []string) bool {
+	if len(patterns) == 0 {
+		return true
+	}
+
+	for _, v := range values {
+		if glob.MatchAny(patterns, v) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func matchPaths(patterns []string, paths []string) bool {
+	if len(patterns) == 0 {
+		return true
+	}
+
+	for _, p := range paths {
+		if glob.MatchAnyPath(patterns, p) {
+			return true
+		}
+	}
+
+	return false
+}
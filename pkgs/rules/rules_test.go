@@ -0,0 +1,127 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package rules
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestEvaluate(t *testing.T) {
+	rs := Rules{
+		{
+			Name:  "vendored",
+			Match: Match{Projects: []string{"INFRA"}, Paths: []string{"vendor/**", "*.lock"}},
+			Flags: "S",
+		},
+		{
+			Name:  "bots",
+			Match: Match{Authors: []string{"renovate-bot"}, Actions: []string{"COMMENTED"}},
+			Drop:  true,
+		},
+		{
+			Name:   "infra",
+			Match:  Match{Projects: []string{"INFRA"}},
+			Folder: "Infra",
+		},
+		{
+			Name:    "reviews",
+			Match:   Match{Reviewers: []string{"jdoe"}, Labels: []string{"team-*"}},
+			Headers: map[string]string{"X-Review": "yes"},
+		},
+	}
+
+	tests := []struct {
+		name string
+		msg  Message
+		want string
+	}{
+		{
+			name: "first match wins",
+			msg:  Message{Project: "INFRA", Paths: []string{"src/main.go", "web/yarn.lock"}},
+			want: "vendored",
+		},
+		{
+			name: "later rule when paths do not match",
+			msg:  Message{Project: "INFRA", Paths: []string{"src/main.go"}},
+			want: "infra",
+		},
+		{
+			name: "drop",
+			msg:  Message{Project: "FOO", Author: "renovate-bot", Action: "COMMENTED"},
+			want: "bots",
+		},
+		{
+			name: "every key must match",
+			msg:  Message{Project: "FOO", Author: "renovate-bot", Action: "OPENED"},
+		},
+		{
+			name: "any of several values",
+			msg:  Message{Project: "FOO", Reviewers: []string{"asmith", "jdoe"}, Labels: []string{"go", "team-infra"}},
+			want: "reviews",
+		},
+		{
+			name: "no values",
+			msg:  Message{Project: "FOO", Reviewers: []string{"jdoe"}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, ok := rs.Evaluate(tt.msg)
+			if ok != (tt.want != "") || r.Name != tt.want {
+				t.Errorf("Evaluate() = %q, %t, want %q", r.Name, ok, tt.want)
+			}
+		})
+	}
+
+	if r, _ := rs.Evaluate(Message{Author: "renovate-bot", Action: "COMMENTED"}); !r.Drop {
+		t.Errorf("Evaluate() = %q, want a dropping rule", r.Name)
+	}
+}
+
+func TestNeed(t *testing.T) {
+	rs := Rules{{Match: Match{Projects: []string{"INFRA"}}}}
+	if rs.NeedPaths() || rs.NeedLabels() {
+		t.Error("rules without paths or labels need them")
+	}
+
+	rs = append(rs, Rule{Match: Match{Paths: []string{"*.lock"}, Labels: []string{"go"}}})
+	if !rs.NeedPaths() || !rs.NeedLabels() {
+		t.Error("rules with paths and labels do not need them")
+	}
+}
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name string
+		rule Rule
+		err  string
+	}{
+		{name: "valid", rule: Rule{Folder: "Projects.infra", Flags: "SF", Headers: map[string]string{"X-Team": "infra"}}},
+		{name: "reserved header", rule: Rule{Headers: map[string]string{"message-id": "x"}}, err: "reserved"},
+		{name: "references", rule: Rule{Headers: map[string]string{"References": "x"}}, err: "reserved"},
+		{name: "content type", rule: Rule{Headers: map[string]string{"Content-Type": "text/html"}}, err: "reserved"},
+		{name: "mailpail header", rule: Rule{Headers: map[string]string{"X-Mailpail-State": "MERGED"}}, err: "reserved"},
+		{name: "invalid header", rule: Rule{Headers: map[string]string{"X Team": "infra"}}, err: "invalid header"},
+		{name: "unknown flag", rule: Rule{Flags: "Sx"}, err: "unknown flag"},
+		{name: "folder with slash", rule: Rule{Folder: "a/b"}, err: "invalid folder"},
+		{name: "folder with dots", rule: Rule{Folder: "..cur"}, err: "invalid folder"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := Rules{{Name: "test"}, tt.rule}.Validate()
+			switch {
+			case tt.err == "" && err != nil:
+				t.Errorf("Validate() = %v", err)
+			case tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)):
+				t.Errorf("Validate() = %v, want %q", err, tt.err)
+			case err != nil && !strings.HasPrefix(err.Error(), "rule #2: "):
+				t.Errorf("Validate() = %v, want it to name the rule", err)
+			}
+		})
+	}
+}